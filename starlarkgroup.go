@@ -6,20 +6,126 @@ package starlarkgroup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime/debug"
 	"sort"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	starlarktime "go.starlark.net/lib/time"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
 )
 
 // Make creates a new group instance. Accepts the following optional kwargs:
-// "n", "every", "burst".
+// "n", "every", "burst", "timeout", "fail_fast", "name", "locals", "retries",
+// "backoff", "backoff_max", "reuse_workers", "strict_ctx", "concurrency",
+// "rps", "jitter", "seed", "timings", "config", "resolver", "serial",
+// "max_pending", "stream", "default", "max_steps", "slow_threshold", "dedup",
+// "cache", "order".
+//
+// N limits the number of calls running concurrently, zero is unlimited.
+// Concurrency is an alias of n.
+//
+// Every rate limits calls to one per duration with bursts of up to burst
+// calls, zero is unlimited and shorter durations must be at least 1µs. Rps is
+// an alternative to every, limiting calls per second. Burst defaults to one
+// when rate limited. Jitter delays each call by a random duration up to jitter
+// after the rate limit, avoiding aligned calls across groups. Seed fixes the
+// source of the random delays for reproducible tests.
+//
+// Each call runs on a new thread named after the group and the index of the
+// call, "group[0]", "group[1]"... A name replaces the "group" prefix. Locals
+// lists the keys of thread locals copied from the waiting thread to each call
+// thread.
+//
+// A timeout bounds the total execution of the group, after which wait returns
+// the context deadline error. The group context is derived from the "context"
+// thread local, so cancellation of the parent propagates and a timeout never
+// extends past the parent deadline.
+//
+// Retries is the number of times a failed call is retried, only the error of
+// the final attempt is reported. Backoff is the delay before the first retry,
+// doubling for each retry after up to backoff_max.
+//
+// By default the group fails fast: the first error cancels the group and is
+// returned from wait. With fail_fast=False every call is run and wait returns
+// a tuple where failed calls hold an error value in their slot, for example
+// (1, error("boom"), 9). Pass raise_errors=True to wait to instead raise an
+// error aggregating all failures. A timeout passed to wait bounds only that
+// wait. An on_result function passed to wait is called with the index and
+// result of each call as it completes, serially on the waiting thread. With
+// as_list=True wait returns a new list rather than a tuple. With as_dict=True
+// wait returns a dict of the results by call index, omit_errors=True leaves
+// out the failed calls even if a default is given.
+//
+// With fail_fast=False the slots of failed calls hold the frozen default value
+// instead of an error value, if a default is given. Errors are still raised
+// with raise_errors=True.
+//
+// A call returning a new group waits it on the worker thread, the results of
+// nested groups are then flattened in place of the group, depth first in order
+// of calling. Wait, collect, wait_partial, sorted, filter, reduce, indexing and
+// iterating the group all see the flattened results. Results keyed by call,
+// wait(as_dict=True) and wait_grouped, keep one slot per call holding the
+// tuple of the flattened results of a nested group.
+//
+// Calls queued after the group is cancelled are dropped, with strict_ctx=True
+// queuing instead fails with the context error.
+//
+// Config is frozen and set as the ConfigKey thread local of each call thread,
+// readable with the Config builtin.
+//
+// Resolver is a mapping of names to functions, go then also accepts the name
+// of a function, g.go("fetch", url).
+//
+// Go also accepts a list or tuple of functions run as a pipeline in a single
+// call, g.go([parse, enrich, store], x) calls store(enrich(parse(x))) and
+// records only the final result.
+//
+// With timings=True the duration of each call is recorded, timings returns a
+// tuple of the durations in seconds in order of calling.
+//
+// Max_pending caps the number of queued calls, queuing more fails with an error
+// rather than blocking. Batches that would exceed the cap queue no calls. With
+// stream=True queuing past the cap instead starts the oldest queued calls,
+// waiting for a worker when n calls are running, so queuing and running
+// overlap.
+//
+// Max_steps bounds the Starlark execution steps of each call, a call past the
+// limit fails with a too many steps error.
+//
+// Cache is a mapping supporting assignment, such as a dict, of results by the
+// cache_key of calls. A call with a cached result isn't run, a successful call
+// stores its frozen result. The group serializes its accesses, the cache must
+// not be otherwise used while the group runs, Go applications sharing a cache
+// between running groups pass a concurrency safe starlark.HasSetKey.
+//
+// With dedup=True calls of the same function and key run once, the result is
+// copied into the slots of the later calls.
+//
+// Calls running longer than slow_threshold are reported with the print
+// function of the waiting thread, naming the call index, function and
+// duration.
+//
+// Order sets the dispatch order of calls to the n workers, "fifo" in order of
+// calling or "lifo" latest first for depth first workloads. Results are still
+// returned in order of calling.
+//
+// With serial=True calls run one at a time in order of calling on the waiting
+// goroutine, ignoring n but still rate limited, for deterministic tests.
+//
+// With reuse_workers=True the n workers persist on the group across waits and
+// resets, stopping when the group is cancelled.
 //
 // An application can add 'group' to the Starlark envrionment like so:
 //
@@ -29,62 +135,693 @@ import (
 //
 func Make(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
-		n     int
-		every starlarktime.Duration
-		burst int
+		n          int
+		every      starlarktime.Duration
+		burstArg   starlark.Value
+		timeout    starlarktime.Duration
+		failFast   = true
+		name       string
+		locals     starlark.Iterable
+		retries    int
+		backoff    starlarktime.Duration
+		backoffMax starlarktime.Duration
+		reuse      bool
+		strictCtx  bool
+		concArg    starlark.Value
+		rpsArg     starlark.Value
+		jitter     starlarktime.Duration
+		timings    bool
+		config     starlark.Value
+		resolver   starlark.Mapping
+		serial     bool
+		maxPending int
+		stream     bool
+		fallback   starlark.Value
+		seed       starlark.Value
+		maxSteps   int
+		slow       starlarktime.Duration
+		dedup      bool
+		cache      starlark.HasSetKey
+		order      = "fifo"
 	)
 	if err := starlark.UnpackArgs(
 		"group", args, kwargs,
-		"n?", &n, "every?", &every, "burst?", &burst,
+		"n?", &n, "every?", &every, "burst?", &burstArg, "timeout?", &timeout,
+		"fail_fast?", &failFast, "name?", &name, "locals?", &locals,
+		"retries?", &retries, "backoff?", &backoff, "backoff_max?", &backoffMax,
+		"reuse_workers?", &reuse, "strict_ctx?", &strictCtx,
+		"concurrency?", &concArg, "rps?", &rpsArg, "jitter?", &jitter,
+		"seed?", &seed, "timings?", &timings, "config?", &config,
+		"resolver?", &resolver, "serial?", &serial,
+		"max_pending?", &maxPending, "stream?", &stream, "default?", &fallback,
+		"max_steps?", &maxSteps, "slow_threshold?", &slow, "dedup?", &dedup,
+		"cache?", &cache, "order?", &order,
 	); err != nil {
 		return nil, err
 	}
 
-	r := rate.Inf
-	if every.Truth() {
-		d := time.Duration(every)
-		r = rate.Every(d)
+	var localKeys []string
+	if locals != nil {
+		iter := locals.Iterate()
+		defer iter.Done()
+		var x starlark.Value
+		for iter.Next(&x) {
+			key, ok := starlark.AsString(x)
+			if !ok {
+				return nil, fmt.Errorf("group: for parameter locals: got %s, want string", x.Type())
+			}
+			localKeys = append(localKeys, key)
+		}
+	}
+
+	if concArg != nil {
+		concurrency, err := starlark.AsInt32(concArg)
+		if err != nil {
+			return nil, fmt.Errorf("group: for parameter concurrency: %v", err)
+		}
+		if n != 0 && n != concurrency {
+			return nil, fmt.Errorf("group: got n=%d and concurrency=%d, want one", n, concurrency)
+		}
+		n = concurrency
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("group: for parameter n: got %d, want non-negative", n)
+	}
+	if order != "fifo" && order != "lifo" {
+		return nil, fmt.Errorf("group: for parameter order: got %q, want \"fifo\" or \"lifo\"", order)
+	}
+	if slow < 0 {
+		return nil, fmt.Errorf("group: for parameter slow_threshold: got %s, want non-negative", slow)
+	}
+	if maxSteps < 0 {
+		return nil, fmt.Errorf("group: for parameter max_steps: got %d, want non-negative", maxSteps)
+	}
+	if maxPending < 0 {
+		return nil, fmt.Errorf("group: for parameter max_pending: got %d, want non-negative", maxPending)
+	}
+	if stream && maxPending == 0 {
+		return nil, fmt.Errorf("group: for parameter stream: want max_pending")
+	}
+	if err := checkEvery(every); err != nil {
+		return nil, fmt.Errorf("group: for parameter every: %v", err)
+	}
+	var seedValue int64
+	if seed != nil {
+		i, ok := seed.(starlark.Int)
+		if !ok {
+			return nil, fmt.Errorf("group: for parameter seed: got %s, want int", seed.Type())
+		}
+		if seedValue, ok = i.Int64(); !ok {
+			return nil, fmt.Errorf("group: for parameter seed: %s out of range", i)
+		}
+	}
+	if jitter < 0 {
+		return nil, fmt.Errorf("group: for parameter jitter: got %s, want non-negative", jitter)
+	}
+	r := everyLimit(every)
+	if rpsArg != nil {
+		rps, ok := starlark.AsFloat(rpsArg)
+		if !ok {
+			return nil, fmt.Errorf("group: for parameter rps: got %s, want float", rpsArg.Type())
+		}
+		if !(rps > 0) {
+			return nil, fmt.Errorf("group: for parameter rps: got %v, want positive", rps)
+		}
+		if max := float64(time.Second / minEvery); rps > max {
+			return nil, fmt.Errorf("group: for parameter rps: got %v, want at most %v", rps, max)
+		}
+		if every.Truth() {
+			return nil, fmt.Errorf("group: got every and rps, want one")
+		}
+		r = rate.Limit(rps)
+	}
+
+	// Default to a burst of one if rate limited.
+	defaultBurst := 0
+	if r != rate.Inf {
+		defaultBurst = 1
+	}
+	burst, err := unpackBurst("group", burstArg, defaultBurst)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, ok := thread.Local("context").(context.Context)
+	if !ok {
+		ctx = context.Background()
+	}
+
+	opts := []Option{
+		WithConcurrency(n),
+		WithRate(r, burst),
+		WithTimeout(time.Duration(timeout)),
+		WithFailFast(failFast),
+		WithRetries(retries, time.Duration(backoff), time.Duration(backoffMax)),
+	}
+	if name != "" {
+		opts = append(opts, WithName(name))
+	}
+	if seed != nil {
+		opts = append(opts, WithRand(rand.New(rand.NewSource(seedValue))))
+	}
+	if config != nil {
+		opts = append(opts, WithConfig(config))
+	}
+	if fallback != nil {
+		opts = append(opts, WithDefault(fallback))
+	}
+	if resolver != nil {
+		opts = append(opts, WithResolver(resolver))
+	}
+	if cache != nil {
+		opts = append(opts, WithCache(cache))
+	}
+	opts = append(opts,
+		WithLocals(localKeys...),
+		WithReuseWorkers(reuse),
+		WithJitter(time.Duration(jitter)),
+		WithTimings(timings),
+		WithStrictCtx(strictCtx),
+		WithSerial(serial),
+		WithMaxPending(maxPending),
+		WithMaxSteps(uint64(maxSteps)),
+		WithSlowThreshold(time.Duration(slow)),
+		WithDedup(dedup),
+		WithLIFO(order == "lifo"),
+		WithStream(stream),
+	)
+	return NewGroup(ctx, opts...), nil
+}
+
+// ConfigKey is the thread local key of the group config on call threads.
+const ConfigKey = "group.config"
+
+// Config returns the config of the group running the call, or None. An
+// application can add it to the environment alongside Make:
+//
+// 	"config": starlark.NewBuiltin("config", starlarkgroup.Config),
+//
+func Config(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
 	}
+	if v, ok := thread.Local(ConfigKey).(starlark.Value); ok {
+		return v, nil
+	}
+	return starlark.None, nil
+}
 
+// Sleep sleeps for the duration, returning early with the error of the thread
+// context if it is cancelled. Calls of a group run with the group context so
+// cancelling the group interrupts the sleep. An application can add it to the
+// environment alongside Make:
+//
+// 	"sleep": starlark.NewBuiltin("sleep", starlarkgroup.Sleep),
+//
+func Sleep(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var d starlarktime.Duration
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &d); err != nil {
+		return nil, err
+	}
 	ctx, ok := thread.Local("context").(context.Context)
 	if !ok {
 		ctx = context.Background()
 	}
+	if !sleepContext(ctx, time.Duration(d)) {
+		return nil, ctx.Err()
+	}
+	return starlark.None, nil
+}
+
+// ContextKey is the type of the context keys set by group.with_value, Go code
+// called by the group reads the values with ctx.Value(ContextKey(key)).
+type ContextKey string
+
+// ContextValue returns the value set by group.with_value for the key on the
+// context of the call, or None. An application can add it to the environment
+// alongside Make:
+//
+// 	"context_value": starlark.NewBuiltin("context_value", starlarkgroup.ContextValue),
+//
+func ContextValue(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key); err != nil {
+		return nil, err
+	}
+	ctx, ok := thread.Local("context").(context.Context)
+	if !ok {
+		return starlark.None, nil
+	}
+	if v, ok := ctx.Value(ContextKey(key)).(starlark.Value); ok {
+		return v, nil
+	}
+	return starlark.None, nil
+}
+
+// minEvery is the shortest every duration, shorter periods can't be
+// meaningfully rate limited with the nanosecond resolution of the limiter.
+const minEvery = time.Microsecond
+
+// checkEvery reports an error for an every duration outside of the accepted
+// range: zero for no limit or at least minEvery.
+func checkEvery(every starlarktime.Duration) error {
+	switch d := time.Duration(every); {
+	case d < 0:
+		return fmt.Errorf("got %s, want non-negative", d)
+	case d > 0 && d < minEvery:
+		return fmt.Errorf("got %s, want at least %s or zero for no limit", d, minEvery)
+	}
+	return nil
+}
+
+// everyLimit converts the every duration to a rate limit, zero is no limit.
+func everyLimit(every starlarktime.Duration) rate.Limit {
+	if !every.Truth() {
+		return rate.Inf
+	}
+	return rate.Every(time.Duration(every))
+}
 
-	return NewGroup(ctx, n, r, burst), nil
+// unpackBurst converts the optional burst argument, returning the default if
+// unset.
+func unpackBurst(fnname string, v starlark.Value, defaultBurst int) (int, error) {
+	if v == nil {
+		return defaultBurst, nil
+	}
+	burst, err := starlark.AsInt32(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: for parameter burst: %v", fnname, err)
+	}
+	if burst < 0 {
+		return 0, fmt.Errorf("%s: for parameter burst: got %d, want non-negative", fnname, burst)
+	}
+	return burst, nil
 }
 
 type callable struct {
-	fn     starlark.Callable
-	args   starlark.Tuple
-	kwargs []starlark.Tuple
+	g        *Group // group the call is queued on, moved by extend
+	i        int    // index of the call in the group
+	fn       starlark.Callable
+	args     starlark.Tuple
+	kwargs   []starlark.Tuple
+	cost     int     // limiter tokens, zero is one
+	priority int     // dispatch order, higher first
+	inline   bool    // executed on the calling thread when queued
+	after    *future // call to complete before starting
+	timeout  time.Duration
+	key      starlark.String   // bucket of wait_grouped
+	weight   int               // calls of the key dispatched per turn, zero is one
+	onError  starlark.Callable // called with the error message for a fallback
+	argFn    starlark.Callable // called at dispatch for more args
+	maxSteps uint64            // execution steps, zero is the group limit
+	noFreeze bool              // args are passed unfrozen
+	dup      *future           // earlier call of the key the result is copied from
+	cacheKey starlark.String   // key of the result in the group cache
+	stop     bool              // returned the stop sentinel
+
+	duration    time.Duration // time spent calling fn, if timed or slow reported
+	limiterWait time.Duration // time spent waiting on the limiter
+
+	started int32         // set by claim
+	done    chan struct{} // closed on completion
+	value   starlark.Value
+	err     error
+}
+
+// claim reports whether the caller is the first to start the call and so must
+// execute it.
+func (c *callable) claim() bool {
+	return atomic.CompareAndSwapInt32(&c.started, 0, 1)
+}
+
+func (c *callable) freeze() {
+	if c.noFreeze {
+		return
+	}
+	c.args.Freeze()
+	for _, kwarg := range c.kwargs {
+		kwarg.Freeze()
+	}
+}
+
+// callOptions are the kwargs of group.go that configure the call rather than
+// being passed to the function.
+var callOptions = map[string]func(c *callable, v starlark.Value) error{
+	"cost": func(c *callable, v starlark.Value) error {
+		cost, err := starlark.AsInt32(v)
+		if err != nil {
+			return err
+		}
+		if cost < 1 {
+			return fmt.Errorf("got %d, want a positive cost", cost)
+		}
+		c.cost = cost
+		return nil
+	},
+	"priority": func(c *callable, v starlark.Value) error {
+		priority, err := starlark.AsInt32(v)
+		if err != nil {
+			return err
+		}
+		c.priority = priority
+		return nil
+	},
+	"inline": func(c *callable, v starlark.Value) error {
+		inline, ok := v.(starlark.Bool)
+		if !ok {
+			return fmt.Errorf("got %s, want bool", v.Type())
+		}
+		c.inline = bool(inline)
+		return nil
+	},
+	"timeout": func(c *callable, v starlark.Value) error {
+		var d starlarktime.Duration
+		if err := d.Unpack(v); err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("got %s, want non-negative", d)
+		}
+		c.timeout = time.Duration(d)
+		return nil
+	},
+	"key": func(c *callable, v starlark.Value) error {
+		key, ok := v.(starlark.String)
+		if !ok {
+			return fmt.Errorf("got %s, want string", v.Type())
+		}
+		c.key = key
+		return nil
+	},
+	"arg_fn": func(c *callable, v starlark.Value) error {
+		fn, ok := v.(starlark.Callable)
+		if !ok {
+			return fmt.Errorf("got %s, want callable", v.Type())
+		}
+		c.argFn = fn
+		return nil
+	},
+	"on_error": func(c *callable, v starlark.Value) error {
+		fn, ok := v.(starlark.Callable)
+		if !ok {
+			return fmt.Errorf("got %s, want callable", v.Type())
+		}
+		c.onError = fn
+		return nil
+	},
+	"cache_key": func(c *callable, v starlark.Value) error {
+		key, ok := v.(starlark.String)
+		if !ok {
+			return fmt.Errorf("got %s, want string", v.Type())
+		}
+		c.cacheKey = key
+		return nil
+	},
+	"freeze": func(c *callable, v starlark.Value) error {
+		freeze, ok := v.(starlark.Bool)
+		if !ok {
+			return fmt.Errorf("got %s, want bool", v.Type())
+		}
+		c.noFreeze = !bool(freeze)
+		return nil
+	},
+	"max_steps": func(c *callable, v starlark.Value) error {
+		steps, err := starlark.AsInt32(v)
+		if err != nil {
+			return err
+		}
+		if steps < 1 {
+			return fmt.Errorf("got %d, want a positive step limit", steps)
+		}
+		c.maxSteps = uint64(steps)
+		return nil
+	},
+	"weight": func(c *callable, v starlark.Value) error {
+		weight, err := starlark.AsInt32(v)
+		if err != nil {
+			return err
+		}
+		if weight < 1 {
+			return fmt.Errorf("got %d, want a positive weight", weight)
+		}
+		c.weight = weight
+		return nil
+	},
+	"after": func(c *callable, v starlark.Value) error {
+		f, ok := v.(*future)
+		if !ok {
+			return fmt.Errorf("got %s, want group.future", v.Type())
+		}
+		c.after = f
+		return nil
+	},
+}
+
+// callError is the result of a failed call in a group that doesn't fail fast.
+type callError struct {
+	err error
 }
 
+func (e callError) String() string        { return fmt.Sprintf("error(%q)", e.err.Error()) }
+func (e callError) Type() string          { return "error" }
+func (e callError) Freeze()               {}
+func (e callError) Truth() starlark.Bool  { return starlark.False }
+func (e callError) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: error") }
+
 // Group implements errgroup.Group in starlark with additional rate limiting.
 // Arguments to go call are frozen. Wait returns a sorted tuple in order of
-// calling. Calls are lazy evaluated and only executed when waiting.
+// calling. Calls are lazy evaluated and only executed when waiting, or when
+// the result of the future returned by go is requested. Cancel aborts the
+// group, running calls are cancelled and further calls to go are dropped.
+// Close instead drains the group, running calls finish but queued calls that
+// haven't started fail and further calls to go fail.
+// Collect runs every call returning a result with the values and errors
+// separated. Reset clears the queued calls so the group can be reused. Flush
+// runs the queued calls returning their results without freezing the group,
+// further calls can be queued and flushed. Extend moves the queued calls of
+// another group onto the group. A call returning the sentinel of stop(value)
+// ends the wait early, cancelling the remaining calls.
+//
+// Go accepts kwargs configuring the call. Cost sets the number of tokens the
+// call takes from the rate limiter, defaulting to one, and can't exceed the
+// burst of a rate limited group. Priority orders dispatch to the workers,
+// higher priorities first. With inline=True the call is executed immediately
+// on the calling thread. After takes the future of an
+// earlier call that must complete successfully before the call starts.
+// Timeout bounds the call alone, a call past its timeout fails with the
+// context deadline error. On_error takes a handler called on the worker
+// thread with the error message of a failed call, its result replaces the
+// error. Arg_fn takes a function called on the worker thread as the call
+// starts, the tuple it returns is appended to the args. Max_steps bounds the
+// execution steps of the call, overriding the group limit. Cache_key is the
+// key of the result in the group cache. Key buckets the result for
+// wait_grouped and shares the workers between keys: calls of equal priority
+// are dispatched taking turns between keys, weight calls of a key per turn
+// defaulting to one.
+//
+// With freeze=False the args of the call are not frozen so the call may mutate
+// them. WARNING: the call runs concurrently with the waiting thread and other
+// calls, any other access to the args while the group runs is a data race.
+// Only pass values that the call alone uses until the wait returns.
+//
+// The kwargs cost, priority, inline, after, timeout, on_error, arg_fn,
+// max_steps, cache_key, key, weight and freeze are reserved by go and never
+// passed to the function. Wrap calls of functions taking a kwarg of the same
+// name to pass it, g.go(lambda: sorted(xs, key = fn)).
+//
+// Group is a starlark.Sequence and starlark.Indexable: len(group) reports the
+// number of calls queued on the group, or of the flattened results once
+// waited, iterating it yields the results in order of calling and group[i] is
+// the i-th result. Iterating or indexing a group that hasn't been waited waits
+// for it, if the wait fails the error value is returned in place of the
+// results. Until waited indexes are bounded by the queued calls, an index past
+// the flattened results returns an error value. A group is true if it has
+// calls queued.
 type Group struct {
+	parent  context.Context
 	ctx     context.Context
-	group   *errgroup.Group
+	cancel  context.CancelFunc
+	timeout time.Duration
 	limiter *rate.Limiter
 
-	frozen bool
+	sharedLimiter bool                // limiter is owned by the caller
+	sem           *semaphore.Weighted // bounds calls across groups, if set
+
+	name          string
+	locals        []string
+	retries       int
+	backoff       time.Duration
+	backoffMax    time.Duration
+	jitter        time.Duration
+	timings       bool           // record call durations
+	config        starlark.Value // frozen, set on call threads
+	fallback      starlark.Value // frozen, slot of failed calls if not nil
+	resolver      starlark.Mapping
+	maxPending    int              // max queued calls, zero is unlimited
+	maxSteps      uint64           // execution steps of each call thread, zero is unlimited
+	slowThreshold time.Duration    // calls running longer are printed, zero is off
+	lifo          bool             // dispatch the latest calls first
+	dedup         bool             // calls of the same fn and key run once
+	dedupKeys     map[dedupKey]int // index of the first call of each fn and key
+	cacheMu       sync.Mutex
+	cache         starlark.HasSetKey // results by cache key, if set
+	stream        bool
+	streamer      *streamer           // started calls past max pending
+	running       chan struct{}       // closed once the workers of the last run return
+	elapsed       time.Duration       // time spent running the queued calls
+	onComplete    []starlark.Callable // called by wait with the results
+	randMu        sync.Mutex
+	rand          *rand.Rand // source of jitter
+	frozen        bool
+	waited        bool          // frozen by a run
+	closed        int32         // set by close, queued calls don't start
+	runs          int32         // runs in progress, reused workers stop after
+	waitDone      chan struct{} // closed when the wait of the group returns
+	failFast      bool
+	strictCtx     bool // error queuing calls on a done context
+	hooks         Hooks
+	startSpan     StartSpanFunc
+
+	serial       bool // run calls in order on the waiting goroutine
+	reuseWorkers bool
+	workersMu    sync.Mutex // guards workers, calls may cancel the group
+	workers      *workers   // started on the first wait when reusing workers
+
+	n       int
+	calls   []*callable
+	results starlark.Tuple
+	err     error // error of an implicit wait
+}
 
-	n     int
-	calls []callable
+// String formats the group configuration and count of calls queued but not
+// yet completed, as in group(n=4, every=100ms, pending=12).
+func (g *Group) String() string {
+	every := "inf"
+	if limit := g.limiter.Limit(); limit != rate.Inf {
+		every = time.Duration(float64(time.Second) / float64(limit)).String()
+	}
+	pending := 0
+	for _, c := range g.calls {
+		select {
+		case <-c.done:
+		default:
+			pending++
+		}
+	}
+	return fmt.Sprintf("group(n=%d, every=%s, pending=%d)", g.n, every, pending)
 }
 
-func (g *Group) String() string       { return "group()" }
 func (g *Group) Type() string         { return "group" }
 func (g *Group) Freeze()              { g.frozen = true }
-func (g *Group) Truth() starlark.Bool { return starlark.Bool(!g.frozen) }
+func (g *Group) Truth() starlark.Bool { return starlark.Bool(len(g.calls) > 0) }
 func (g *Group) Hash() (uint32, error) {
 	return 0, fmt.Errorf("unhashable type: group")
 }
 
+// CompareSameType compares groups by identity.
+func (g *Group) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	switch op {
+	case syntax.EQL:
+		return g == y.(*Group), nil
+	case syntax.NEQ:
+		return g != y.(*Group), nil
+	default:
+		return false, fmt.Errorf("%s %s %s not implemented", g.Type(), op, y.Type())
+	}
+}
+
+var (
+	_ starlark.Sequence   = (*Group)(nil)
+	_ starlark.Indexable  = (*Group)(nil)
+	_ starlark.Comparable = (*Group)(nil)
+)
+
+// Len is the number of queued calls, or of the flattened results once waited.
+func (g *Group) Len() int {
+	if g.results != nil {
+		return len(g.results)
+	}
+	return len(g.calls)
+}
+
+func (g *Group) Iterate() starlark.Iterator {
+	if err := g.implicitWait(); err != nil {
+		return starlark.Tuple{callError{err: err}}.Iterate()
+	}
+	return g.results.Iterate()
+}
+func (g *Group) Index(i int) starlark.Value {
+	if err := g.implicitWait(); err != nil {
+		return callError{err: err}
+	}
+	if g.results == nil {
+		return starlark.None // Frozen but not waited.
+	}
+	// Nested groups may flatten to fewer results than the calls bounding i.
+	if i >= len(g.results) {
+		return callError{err: fmt.Errorf("group index %d out of range, got %d results", i, len(g.results))}
+	}
+	return g.results[i]
+}
+
+// implicitWait waits for the group if it hasn't been waited, reporting the
+// error of the wait.
+func (g *Group) implicitWait() error {
+	return g.waitOn(&starlark.Thread{Name: "group"})
+}
+
+// waitOn waits the group on the thread if it hasn't been frozen, returning the
+// error of the wait.
+func (g *Group) waitOn(thread *starlark.Thread) error {
+	if !g.frozen {
+		g.Freeze()
+		_, g.err = g.run(g.ctx, thread, runOptions{failFast: g.failFast})
+	}
+	return g.err
+}
+
+// resultsOn returns the results of the group, waiting on the thread if
+// needed.
+func (g *Group) resultsOn(thread *starlark.Thread, name string) (starlark.Tuple, error) {
+	if err := g.waitOn(thread); err != nil {
+		return nil, err
+	}
+	if g.results == nil {
+		return nil, g.waitedErr(name)
+	}
+	return g.results, nil
+}
+
 var groupMethods = map[string]*starlark.Builtin{
-	"go":   starlark.NewBuiltin("group.go", group_go),
-	"wait": starlark.NewBuiltin("group.wait", group_wait),
+	"cancel":       starlark.NewBuiltin("group.cancel", group_cancel),
+	"close":        starlark.NewBuiltin("group.close", group_close),
+	"collect":      starlark.NewBuiltin("group.collect", group_collect),
+	"done":         starlark.NewBuiltin("group.done", group_done),
+	"err":          starlark.NewBuiltin("group.err", group_err),
+	"extend":       starlark.NewBuiltin("group.extend", group_extend),
+	"filter":       starlark.NewBuiltin("group.filter", group_filter),
+	"flush":        starlark.NewBuiltin("group.flush", group_flush),
+	"go":           starlark.NewBuiltin("group.go", group_go),
+	"go_batch":     starlark.NewBuiltin("group.go_batch", group_go_batch),
+	"len":          starlark.NewBuiltin("group.len", group_len),
+	"limit":        starlark.NewBuiltin("group.limit", group_limit),
+	"map":          starlark.NewBuiltin("group.map", group_map),
+	"on_complete":  starlark.NewBuiltin("group.on_complete", group_on_complete),
+	"reduce":       starlark.NewBuiltin("group.reduce", group_reduce),
+	"reset":        starlark.NewBuiltin("group.reset", group_reset),
+	"set_limit":    starlark.NewBuiltin("group.set_limit", group_set_limit),
+	"starmap":      starlark.NewBuiltin("group.starmap", group_starmap),
+	"sorted":       starlark.NewBuiltin("group.sorted", group_sorted),
+	"stats":        starlark.NewBuiltin("group.stats", group_stats),
+	"stop":         starlark.NewBuiltin("group.stop", group_stop),
+	"stream":       starlark.NewBuiltin("group.stream", group_stream),
+	"timings":      starlark.NewBuiltin("group.timings", group_timings),
+	"wait":         starlark.NewBuiltin("group.wait", group_wait),
+	"wait_any":     starlark.NewBuiltin("group.wait_any", group_wait_any),
+	"wait_grouped": starlark.NewBuiltin("group.wait_grouped", group_wait_grouped),
+	"wait_n":       starlark.NewBuiltin("group.wait_n", group_wait_n),
+	"wait_partial": starlark.NewBuiltin("group.wait_partial", group_wait_partial),
+	"with_value":   starlark.NewBuiltin("group.with_value", group_with_value),
 }
 
 func (g *Group) Attr(name string) (starlark.Value, error) {
@@ -104,148 +841,2443 @@ func (g *Group) AttrNames() []string {
 	return names
 }
 
-// NewGroup creates a new Group with context, number of routines, rate limit and
-// burst limit.
-func NewGroup(ctx context.Context, n int, r rate.Limit, b int) *Group {
-	group, ctx := errgroup.WithContext(ctx)
-	limiter := rate.NewLimiter(r, b)
-
-	return &Group{
-		ctx:     ctx,
-		group:   group,
-		limiter: limiter,
-		n:       n,
-	}
-}
-
-func group_go(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	if len(args) == 0 {
-		return nil, fmt.Errorf("group.go: missing function arg")
+// NewGroup creates a new Group with the context and options. By default the
+// group has unlimited concurrency and rate, and fails fast.
+func NewGroup(ctx context.Context, opts ...Option) *Group {
+	g := &Group{
+		parent:   ctx,
+		limiter:  rate.NewLimiter(rate.Inf, 0),
+		name:     "group",
+		failFast: true,
 	}
-	fn, ok := args[0].(starlark.Callable)
-	if !ok {
-		return nil, fmt.Errorf("group.go: expected callable got %T", args[0])
+	for _, opt := range opts {
+		opt(g)
 	}
+	g.init()
+	return g
+}
 
-	g := b.Receiver().(*Group)
-	if g.frozen {
-		return nil, fmt.Errorf("group: frozen")
-	}
+// NewGroupLimit creates a new Group with context, number of routines, rate
+// limit and burst limit.
+//
+// Deprecated: use NewGroup with WithConcurrency and WithRate.
+func NewGroupLimit(ctx context.Context, n int, r rate.Limit, b int) *Group {
+	return NewGroup(ctx, WithConcurrency(n), WithRate(r, b))
+}
 
-	if g.ctx.Err() != nil {
-		return starlark.None, nil // Context cancelled
-	}
+// Option configures a Group created by NewGroup.
+type Option func(*Group)
 
-	g.calls = append(g.calls, callable{
-		fn:     fn,
-		args:   args[1:],
-		kwargs: kwargs,
-	})
-	return starlark.None, nil
+// WithConcurrency limits the number of calls running concurrently, zero is
+// unlimited.
+func WithConcurrency(n int) Option {
+	return func(g *Group) { g.n = n }
 }
 
-func group_wait(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	g := b.Receiver().(*Group)
-	if g.frozen {
-		return nil, fmt.Errorf("group.wait: frozen")
+// WithRate rate limits calls to r with bursts of up to b calls.
+func WithRate(r rate.Limit, b int) Option {
+	return func(g *Group) {
+		g.limiter = rate.NewLimiter(r, b)
+		g.sharedLimiter = false
 	}
-	g.Freeze()
+}
 
-	if err := starlark.UnpackArgs("group.wait", args, kwargs); err != nil {
-		return nil, err
-	}
+// WithLimiter sets a rate limiter owned by the caller, see SetLimiter.
+func WithLimiter(l *rate.Limiter) Option {
+	return func(g *Group) { g.SetLimiter(l) }
+}
 
-	var (
-		mu      sync.Mutex
-		printer func(goThread *starlark.Thread, msg string)
-		loader  func(goThread *starlark.Thread, module string) (starlark.StringDict, error)
-	)
-	if thread.Print != nil {
-		printer = func(goThread *starlark.Thread, msg string) {
-			mu.Lock()
-			defer mu.Unlock()
-			thread.Print(goThread, msg)
-		}
-	}
-	if thread.Load != nil {
-		loader = func(goThread *starlark.Thread, module string) (starlark.StringDict, error) {
-			mu.Lock()
-			defer mu.Unlock()
-			return thread.Load(goThread, module)
-		}
-	}
+// WithSemaphore sets a semaphore shared across groups, see SetSemaphore.
+func WithSemaphore(s *semaphore.Weighted) Option {
+	return func(g *Group) { g.SetSemaphore(s) }
+}
 
-	var queue chan func() error
-	elems := make([]starlark.Value, len(g.calls))
-	for i, v := range g.calls {
-		var (
-			i      = i
-			fn     = v.fn
-			args   = v.args
-			kwargs = v.kwargs
-		)
-		args.Freeze()
-		kwargs = make([]starlark.Tuple, len(kwargs))
-		for i, kwarg := range kwargs {
-			kwarg.Freeze()
-			kwargs[i] = kwarg
-		}
+// WithName prefixes the names of the call threads, defaulting to "group".
+func WithName(name string) Option {
+	return func(g *Group) { g.name = name }
+}
 
-		if err := g.limiter.Wait(g.ctx); err != nil {
-			return nil, err
-		}
+// WithTimeout bounds the total execution of the group.
+func WithTimeout(d time.Duration) Option {
+	return func(g *Group) { g.timeout = d }
+}
 
-		call := func() error {
-			thread := &starlark.Thread{
-				Name:  thread.Name + "/" + strconv.Itoa(i),
-				Print: printer,
-				Load:  loader,
-			}
-			thread.SetLocal("context", g.ctx)
+// WithFailFast sets whether the first error cancels the group.
+func WithFailFast(failFast bool) Option {
+	return func(g *Group) { g.failFast = failFast }
+}
 
-			v, err := starlark.Call(thread, fn, args, kwargs)
-			if err != nil {
-				return err
-			}
+// WithRetries retries failed calls up to n times, delaying by backoff doubling
+// up to max.
+func WithRetries(n int, backoff, max time.Duration) Option {
+	return func(g *Group) {
+		g.retries = n
+		g.backoff = backoff
+		g.backoffMax = max
+	}
+}
 
-			elems[i] = v
-			return nil
-		}
+// WithLocals copies the thread locals of the keys from the waiting thread to
+// each call thread.
+func WithLocals(keys ...string) Option {
+	return func(g *Group) { g.locals = keys }
+}
 
-		if g.n <= 0 {
-			g.group.Go(call)
-			continue
-		}
+// WithReuseWorkers keeps the n workers on the group across waits and resets,
+// stopping when the group is cancelled or by StopWorkers.
+func WithReuseWorkers(reuse bool) Option {
+	return func(g *Group) { g.reuseWorkers = reuse }
+}
 
-		if i == 0 {
-			queue = make(chan func() error, g.n)
-		}
+// WithJitter delays each call by a random duration up to d.
+func WithJitter(d time.Duration) Option {
+	return func(g *Group) { g.jitter = d }
+}
 
-		if i < g.n {
-			g.group.Go(func() error {
-				for call := range queue {
-					if err := call(); err != nil {
-						return err
-					}
-				}
-				return nil
-			})
-		}
+// WithRand sets the source of jitter, see SetRand.
+func WithRand(r *rand.Rand) Option {
+	return func(g *Group) { g.SetRand(r) }
+}
 
-		select {
-		case queue <- call:
-		case <-g.ctx.Done():
-			return nil, g.ctx.Err()
-		}
-	}
+// WithTimings records the duration of each call.
+func WithTimings(timings bool) Option {
+	return func(g *Group) { g.timings = timings }
+}
 
-	if queue != nil {
-		close(queue)
+// WithConfig freezes and sets the config of the call threads, readable with
+// the Config builtin.
+func WithConfig(v starlark.Value) Option {
+	return func(g *Group) {
+		v.Freeze()
+		g.config = v
 	}
+}
 
-	if err := g.group.Wait(); err != nil {
-		return nil, err
+// WithDefault freezes and sets the slot of failed calls when not failing
+// fast.
+func WithDefault(v starlark.Value) Option {
+	return func(g *Group) {
+		v.Freeze()
+		g.fallback = v
 	}
+}
+
+// WithStrictCtx fails queuing calls on a done context rather than dropping
+// them.
+func WithStrictCtx(strict bool) Option {
+	return func(g *Group) { g.strictCtx = strict }
+}
+
+// WithResolver looks up go arguments naming a function in m.
+func WithResolver(m starlark.Mapping) Option {
+	return func(g *Group) { g.resolver = m }
+}
+
+// WithSerial runs calls one at a time in order of calling on the waiting
+// goroutine.
+func WithSerial(serial bool) Option {
+	return func(g *Group) { g.serial = serial }
+}
+
+// WithMaxPending caps the number of queued calls, zero is unlimited.
+func WithMaxPending(n int) Option {
+	return func(g *Group) { g.maxPending = n }
+}
+
+// WithMaxSteps bounds the execution steps of each call thread, zero is
+// unlimited.
+func WithMaxSteps(n uint64) Option {
+	return func(g *Group) { g.maxSteps = n }
+}
+
+// WithSlowThreshold prints calls running longer than d, zero is off.
+func WithSlowThreshold(d time.Duration) Option {
+	return func(g *Group) { g.slowThreshold = d }
+}
 
-	return starlark.Tuple(elems), nil
+// WithDedup runs calls of the same function and key once.
+func WithDedup(dedup bool) Option {
+	return func(g *Group) { g.dedup = dedup }
+}
+
+// WithCache caches the results of calls with a cache key in m.
+func WithCache(m starlark.HasSetKey) Option {
+	return func(g *Group) { g.cache = m }
+}
+
+// WithLIFO dispatches the latest calls first.
+func WithLIFO(lifo bool) Option {
+	return func(g *Group) { g.lifo = lifo }
+}
+
+// WithStream starts the oldest queued calls once max pending is reached.
+func WithStream(stream bool) Option {
+	return func(g *Group) { g.stream = stream }
+}
+
+// WithHooks sets the hooks observing the calls, see SetHooks.
+func WithHooks(h Hooks) Option {
+	return func(g *Group) { g.hooks = h }
+}
+
+// SetLimiter replaces the rate limiter of the group with a limiter owned by the
+// caller, which may be shared across groups to share a rate budget. The rate
+// and burst of the group are ignored and set_limit fails.
+func (g *Group) SetLimiter(l *rate.Limiter) {
+	g.limiter = l
+	g.sharedLimiter = true
+}
+
+// SetSemaphore sets a semaphore owned by the caller that each call acquires a
+// unit of while running, bounding the running calls of every group sharing it
+// independently of n.
+func (g *Group) SetSemaphore(s *semaphore.Weighted) {
+	g.sem = s
+}
+
+// Done returns a channel closed when the wait of the group returns, with or
+// without error. A reset replaces the channel.
+func (g *Group) Done() <-chan struct{} { return g.waitDone }
+
+// Results returns the results of the last successful wait in order of
+// calling with nested groups flattened, or nil before the group has been
+// waited.
+func (g *Group) Results() starlark.Tuple { return g.results }
+
+// Hooks observe the calls of a group. Methods may be called concurrently.
+type Hooks interface {
+	// OnSchedule is called when call i is queued.
+	OnSchedule(i int)
+	// OnStart is called before call i runs.
+	OnStart(i int)
+	// OnComplete is called after call i runs with the error of the call.
+	OnComplete(i int, err error)
+}
+
+// SetHooks sets the hooks observing the calls, nil disables them.
+func (g *Group) SetHooks(h Hooks) { g.hooks = h }
+
+// StartSpanFunc starts a span named after the callable, returning the span
+// context and a function to end the span with the error of the call.
+type StartSpanFunc func(ctx context.Context, name string) (context.Context, func(err error))
+
+// SetStartSpan sets the function starting a span for each call, nil disables
+// tracing.
+func (g *Group) SetStartSpan(fn StartSpanFunc) { g.startSpan = fn }
+
+// workers are the goroutines of a group reused across waits.
+type workers struct {
+	work chan func()
+	quit chan struct{}
+}
+
+// startWorkers starts n workers that run until closed or the parent context
+// is done.
+func (g *Group) startWorkers() *workers {
+	w := &workers{
+		work: make(chan func()),
+		quit: make(chan struct{}),
+	}
+	parentDone := g.parent.Done()
+	for i := 0; i < g.n; i++ {
+		go func() {
+			for {
+				select {
+				case fn := <-w.work:
+					fn()
+				case <-w.quit:
+					return
+				case <-parentDone:
+					return
+				}
+			}
+		}()
+	}
+	return w
+}
+
+// dispatch runs the calls in order on the workers, waiting for them to
+// complete. The first error stops the run.
+func (w *workers) dispatch(ctx context.Context, order []int, call func(int) error, stop func()) error {
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		callErr error
+	)
+	for _, i := range order {
+		i := i
+		wg.Add(1)
+		fn := func() {
+			defer wg.Done()
+			if err := call(i); err != nil {
+				once.Do(func() {
+					callErr = err
+					stop()
+				})
+			}
+		}
+		select {
+		case w.work <- fn:
+		case <-ctx.Done():
+			wg.Done()
+			wg.Wait()
+			if callErr != nil {
+				return callErr
+			}
+			return ctx.Err()
+		}
+	}
+	wg.Wait()
+	return callErr
+}
+
+// StopWorkers stops the workers of a group reusing workers. Running calls
+// finish, the next wait starts new workers. Unlike close in Starlark the group
+// isn't drained. It may be called concurrently, calls can cancel the group.
+func (g *Group) StopWorkers() {
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	if g.workers != nil {
+		close(g.workers.quit)
+		g.workers = nil
+	}
+}
+
+// init derives the group context from the parent context.
+func (g *Group) init() {
+	g.waitDone = make(chan struct{})
+	if g.timeout > 0 {
+		g.ctx, g.cancel = context.WithTimeout(g.parent, g.timeout)
+	} else {
+		g.ctx, g.cancel = context.WithCancel(g.parent)
+	}
+}
+
+func group_go(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("group.go: missing function arg")
+	}
+	g := b.Receiver().(*Group)
+	var (
+		fn  starlark.Callable
+		err error
+	)
+	switch v := args[0].(type) {
+	case *starlark.List, starlark.Tuple:
+		fn, err = g.resolvePipeline(v.(starlark.Indexable))
+	default:
+		fn, err = g.resolve(v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("group.go: for parameter 1: %v", err)
+	}
+
+	f, err := g.queue(thread, fn, args[1:], kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return starlark.None, nil // Context cancelled
+	}
+	return f, nil
+}
+
+// resolve returns the callable of the go argument, strings naming a function
+// are looked up in the resolver.
+func (g *Group) resolve(v starlark.Value) (starlark.Callable, error) {
+	if fn, ok := v.(starlark.Callable); ok {
+		return fn, nil
+	}
+	name, ok := v.(starlark.String)
+	if !ok || g.resolver == nil {
+		return nil, fmt.Errorf("got %s, want callable", v.Type())
+	}
+	x, found, err := g.resolver.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("name %s not found", name)
+	}
+	fn, ok := x.(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("name %s is %s, want callable", name, x.Type())
+	}
+	return fn, nil
+}
+
+// resolvePipeline returns a pipeline of the resolved functions of the list.
+func (g *Group) resolvePipeline(x starlark.Indexable) (*pipeline, error) {
+	if x.Len() == 0 {
+		return nil, fmt.Errorf("got empty pipeline, want at least one function")
+	}
+	p := &pipeline{fns: make([]starlark.Callable, x.Len())}
+	for i := range p.fns {
+		fn, err := g.resolve(x.Index(i))
+		if err != nil {
+			return nil, fmt.Errorf("pipeline element %d: %v", i, err)
+		}
+		p.fns[i] = fn
+	}
+	return p, nil
+}
+
+// pipeline calls the first function with the call args, then each following
+// function with the result of the one before.
+type pipeline struct {
+	fns []starlark.Callable
+}
+
+var _ starlark.Callable = (*pipeline)(nil)
+
+func (p *pipeline) Name() string          { return "pipeline" }
+func (p *pipeline) Type() string          { return "group.pipeline" }
+func (p *pipeline) Truth() starlark.Bool  { return starlark.True }
+func (p *pipeline) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: group.pipeline") }
+func (p *pipeline) String() string {
+	names := make([]string, len(p.fns))
+	for i, fn := range p.fns {
+		names[i] = fn.Name()
+	}
+	return fmt.Sprintf("pipeline(%s)", strings.Join(names, ", "))
+}
+func (p *pipeline) Freeze() {
+	for _, fn := range p.fns {
+		fn.Freeze()
+	}
+}
+
+func (p *pipeline) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	v, err := starlark.Call(thread, p.fns[0], args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range p.fns[1:] {
+		if v, err = starlark.Call(thread, fn, starlark.Tuple{v}, nil); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// waitMethods are the methods of a group that wait for its calls.
+var waitMethods = map[string]bool{
+	"collect":      true,
+	"filter":       true,
+	"flush":        true,
+	"reduce":       true,
+	"sorted":       true,
+	"wait":         true,
+	"wait_any":     true,
+	"wait_grouped": true,
+	"wait_n":       true,
+	"wait_partial": true,
+}
+
+// checkSelf reports an error if fn waits on the group, which would deadlock
+// when called by the group.
+func (g *Group) checkSelf(fn starlark.Callable) error {
+	if p, ok := fn.(*pipeline); ok {
+		for _, fn := range p.fns {
+			if err := g.checkSelf(fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	b, ok := fn.(*starlark.Builtin)
+	if !ok || b.Receiver() != g {
+		return nil
+	}
+	if name := strings.TrimPrefix(b.Name(), "group."); waitMethods[name] {
+		return fmt.Errorf("can't queue %s of the same group, it would deadlock", b.Name())
+	}
+	return nil
+}
+
+// checkPending reports an error if queuing k more calls exceeds the max
+// pending calls.
+func (g *Group) checkPending(k int) error {
+	if g.stream {
+		return nil // Drained as calls are queued.
+	}
+	if n := len(g.calls) + k; g.maxPending > 0 && n > g.maxPending {
+		return fmt.Errorf("%d pending calls exceed max_pending %d", n, g.maxPending)
+	}
+	return nil
+}
+
+// streamer runs the oldest queued calls of a streaming group as calls are
+// queued past the max pending calls.
+type streamer struct {
+	e     *env
+	slots chan struct{} // bounds running calls by n, nil is unbounded
+	wg    sync.WaitGroup
+	next  int // index of the oldest call that may not have started
+
+	once sync.Once
+	err  error // first error of a fail fast group
+}
+
+// drain starts the oldest queued calls of a streaming group until no more than
+// max pending calls are queued, blocking for a worker if n calls are running.
+func (g *Group) drain(thread *starlark.Thread) {
+	if !g.stream {
+		return
+	}
+	s := g.streamer
+	if s == nil {
+		s = &streamer{e: g.newEnv(g.ctx, thread)}
+		if g.n > 0 {
+			s.slots = make(chan struct{}, g.n)
+		}
+		g.streamer = s
+	}
+
+	for len(g.calls)-s.next > g.maxPending {
+		i, c := s.next, g.calls[s.next]
+		s.next++
+		if !c.claim() {
+			continue // Started by its future.
+		}
+		c.freeze()
+		if g.serial {
+			g.execute(s.e, i, c)
+			continue
+		}
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+			case <-g.ctx.Done():
+				c.err = fmt.Errorf("group call %d (%s): %w", i, c.fn.Name(), g.ctx.Err())
+				close(c.done)
+				continue
+			}
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			g.execute(s.e, i, c)
+			if s.slots != nil {
+				<-s.slots
+			}
+			if c.err != nil && g.failFast {
+				s.once.Do(func() { s.err = c.err })
+				g.cancel()
+			}
+		}()
+	}
+}
+
+// Add queues a call of fn like group.go, kwargs configuring the call are
+// consumed. Calls queued on a cancelled group are dropped.
+func (g *Group) Add(fn starlark.Callable, args starlark.Tuple, kwargs []starlark.Tuple) error {
+	_, err := g.queue(&starlark.Thread{Name: g.name}, fn, args, kwargs)
+	return err
+}
+
+// waitedErr returns the error of waiting a frozen group, explaining whether
+// the results of an earlier wait are retrievable.
+func (g *Group) waitedErr(name string) error {
+	switch {
+	case !g.waited:
+		return fmt.Errorf("%s: frozen", name)
+	case g.results != nil:
+		return fmt.Errorf("%s: already waited, results are available by indexing the group; create a new group or call reset()", name)
+	default:
+		return fmt.Errorf("%s: already waited and failed, results are not available; create a new group or call reset()", name)
+	}
+}
+
+// Wait runs the queued calls like group.wait on the thread, returning the
+// results in order of calling with nested groups flattened. On error the
+// results of the completed calls are returned with the error. If the parent
+// context is done Wait returns its error without waiting for the running calls.
+func (g *Group) Wait(thread *starlark.Thread) (starlark.Tuple, error) {
+	if g.frozen {
+		return nil, g.waitedErr("group.wait")
+	}
+	g.Freeze()
+	elems, err := g.run(g.ctx, thread, runOptions{failFast: g.failFast})
+	if err != nil {
+		return g.withDefault(flatten(elems)), err
+	}
+	return g.results, nil
+}
+
+// queue queues a call for group.go returning its future, or nil if the call
+// was dropped as the context is done. Inline calls are executed on the thread.
+func (g *Group) queue(thread *starlark.Thread, fn starlark.Callable, args starlark.Tuple, kwargs []starlark.Tuple) (*future, error) {
+	if g.frozen {
+		return nil, fmt.Errorf("group: frozen")
+	}
+	if g.isClosed() {
+		return nil, fmt.Errorf("group.go: closed")
+	}
+
+	if err := g.ctx.Err(); err != nil {
+		if g.strictCtx {
+			return nil, fmt.Errorf("group.go: %v", err)
+		}
+		return nil, nil
+	}
+
+	if err := g.checkSelf(fn); err != nil {
+		return nil, fmt.Errorf("group.go: %v", err)
+	}
+	if err := g.checkPending(1); err != nil {
+		return nil, fmt.Errorf("group.go: %v", err)
+	}
+
+	c := &callable{fn: fn, args: args}
+	for _, kwarg := range kwargs {
+		name := string(kwarg[0].(starlark.String))
+		if setOption, ok := callOptions[name]; ok {
+			if err := setOption(c, kwarg[1]); err != nil {
+				return nil, fmt.Errorf("group.go: for parameter %s: %v", name, err)
+			}
+			continue
+		}
+		c.kwargs = append(c.kwargs, kwarg)
+	}
+	// The limiter never grants more tokens than its burst.
+	if b := g.limiter.Burst(); c.cost > b && g.limiter.Limit() != rate.Inf {
+		return nil, fmt.Errorf("group.go: for parameter cost: got %d, want at most the burst %d", c.cost, b)
+	}
+	// Dependencies are on earlier calls of the group so can't form cycles.
+	if a := c.after; a != nil && (a.c.g != g || a.c.i >= len(g.calls) || g.calls[a.c.i] != a.c) {
+		return nil, fmt.Errorf("group.go: for parameter after: %s not queued on the group", a)
+	}
+	f := g.add(c)
+	if c.inline {
+		f.start(thread)
+	}
+	g.drain(thread)
+	return f, nil
+}
+
+// add queues the call returning its future.
+func (g *Group) add(c *callable) *future {
+	c.done = make(chan struct{})
+	g.calls = append(g.calls, c)
+	i := len(g.calls) - 1
+	c.g, c.i = g, i
+	if g.hooks != nil {
+		g.hooks.OnSchedule(i)
+	}
+	f := &future{c: c}
+	if g.dedup && c.key != "" {
+		k := dedupKey{fn: c.fn, key: c.key}
+		if j, ok := g.dedupKeys[k]; ok {
+			c.dup = &future{c: g.calls[j]}
+		} else {
+			if g.dedupKeys == nil {
+				g.dedupKeys = make(map[dedupKey]int)
+			}
+			g.dedupKeys[k] = i
+		}
+	}
+	return f
+}
+
+// dedupKey identifies calls run once with dedup.
+type dedupKey struct {
+	fn  starlark.Callable
+	key starlark.String
+}
+
+// group_go_batch queues a call of fn for each tuple of arguments, returning
+// None.
+func group_go_batch(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		fn    starlark.Callable
+		batch starlark.Iterable
+	)
+	if err := starlark.UnpackArgs(
+		"group.go_batch", args, kwargs, "fn", &fn, "args", &batch,
+	); err != nil {
+		return nil, err
+	}
+
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.go_batch: frozen")
+	}
+	if g.isClosed() {
+		return nil, fmt.Errorf("group.go_batch: closed")
+	}
+	if err := g.checkSelf(fn); err != nil {
+		return nil, fmt.Errorf("group.go_batch: %v", err)
+	}
+
+	if err := g.ctx.Err(); err != nil {
+		if g.strictCtx {
+			return nil, fmt.Errorf("group.go_batch: %v", err)
+		}
+		return starlark.None, nil // Context cancelled
+	}
+
+	iter := batch.Iterate()
+	defer iter.Done()
+	var (
+		x     starlark.Value
+		calls []*callable
+	)
+	for i := 0; iter.Next(&x); i++ {
+		callArgs, ok := x.(starlark.Tuple)
+		if !ok {
+			return nil, fmt.Errorf("group.go_batch: element %d: got %s, want tuple", i, x.Type())
+		}
+		callArgs.Freeze()
+		calls = append(calls, &callable{
+			fn:   fn,
+			args: callArgs,
+		})
+	}
+	if err := g.checkPending(len(calls)); err != nil {
+		return nil, fmt.Errorf("group.go_batch: %v", err)
+	}
+	for _, c := range calls {
+		g.add(c)
+	}
+	g.drain(thread)
+	return starlark.None, nil
+}
+
+// group_map queues a call of fn for each element of the iterable, returning
+// None. Keyword arguments are passed to every call.
+func group_map(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		fn       starlark.Callable
+		iterable starlark.Iterable
+	)
+	if err := starlark.UnpackPositionalArgs(
+		"group.map", args, nil, 2, &fn, &iterable,
+	); err != nil {
+		return nil, err
+	}
+
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.map: frozen")
+	}
+	if g.isClosed() {
+		return nil, fmt.Errorf("group.map: closed")
+	}
+	if err := g.checkSelf(fn); err != nil {
+		return nil, fmt.Errorf("group.map: %v", err)
+	}
+
+	if err := g.ctx.Err(); err != nil {
+		if g.strictCtx {
+			return nil, fmt.Errorf("group.map: %v", err)
+		}
+		return starlark.None, nil // Context cancelled
+	}
+
+	// Shared by each call.
+	for _, kwarg := range kwargs {
+		kwarg.Freeze()
+	}
+
+	var calls []*callable
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var x starlark.Value
+	for iter.Next(&x) {
+		calls = append(calls, &callable{
+			fn:     fn,
+			args:   starlark.Tuple{x},
+			kwargs: kwargs,
+		})
+	}
+	if err := g.checkPending(len(calls)); err != nil {
+		return nil, fmt.Errorf("group.map: %v", err)
+	}
+	for _, c := range calls {
+		g.add(c)
+	}
+	g.drain(thread)
+	return starlark.None, nil
+}
+
+// group_starmap queues a call of fn for each element of the iterable, with
+// the items of the element as positional arguments, returning None.
+func group_starmap(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		fn       starlark.Callable
+		iterable starlark.Iterable
+	)
+	if err := starlark.UnpackPositionalArgs(
+		"group.starmap", args, nil, 2, &fn, &iterable,
+	); err != nil {
+		return nil, err
+	}
+
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.starmap: frozen")
+	}
+	if g.isClosed() {
+		return nil, fmt.Errorf("group.starmap: closed")
+	}
+	if err := g.checkSelf(fn); err != nil {
+		return nil, fmt.Errorf("group.starmap: %v", err)
+	}
+
+	if err := g.ctx.Err(); err != nil {
+		if g.strictCtx {
+			return nil, fmt.Errorf("group.starmap: %v", err)
+		}
+		return starlark.None, nil // Context cancelled
+	}
+
+	// Shared by each call.
+	for _, kwarg := range kwargs {
+		kwarg.Freeze()
+	}
+
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var (
+		x     starlark.Value
+		calls []*callable
+	)
+	for i := 0; iter.Next(&x); i++ {
+		elem := starlark.Iterate(x)
+		if elem == nil {
+			return nil, fmt.Errorf("group.starmap: element %d: got %s, want iterable", i, x.Type())
+		}
+		var (
+			v        starlark.Value
+			callArgs starlark.Tuple
+		)
+		for elem.Next(&v) {
+			callArgs = append(callArgs, v)
+		}
+		elem.Done()
+
+		calls = append(calls, &callable{
+			fn:     fn,
+			args:   callArgs,
+			kwargs: kwargs,
+		})
+	}
+	if err := g.checkPending(len(calls)); err != nil {
+		return nil, fmt.Errorf("group.starmap: %v", err)
+	}
+	for _, c := range calls {
+		g.add(c)
+	}
+	g.drain(thread)
+	return starlark.None, nil
+}
+
+func group_len(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.len", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	return starlark.MakeInt(g.Len()), nil
+}
+
+// group_done reports whether the group context is cancelled or past its
+// deadline.
+func group_done(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.done", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	return starlark.Bool(g.ctx.Err() != nil), nil
+}
+
+// group_err returns the group context error as a string, or None.
+func group_err(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.err", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	if err := g.ctx.Err(); err != nil {
+		return starlark.String(err.Error()), nil
+	}
+	return starlark.None, nil
+}
+
+func group_cancel(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.cancel", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	g.cancel()
+	g.StopWorkers()
+	return starlark.None, nil
+}
+
+// group_close drains the group: running calls finish, queued calls that
+// haven't started fail with a closed error and queuing more calls fails.
+// Unlike cancel the group context is left uncancelled. Reused workers stop
+// once no wait is running.
+func group_close(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.close", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	atomic.StoreInt32(&g.closed, 1)
+	// Reused workers stop now, or once the running wait returns.
+	if atomic.LoadInt32(&g.runs) == 0 {
+		g.StopWorkers()
+	}
+	return starlark.None, nil
+}
+
+// errClosed fails calls not started before the group is closed.
+var errClosed = errors.New("closed")
+
+// isClosed reports whether the group has been closed, safe for concurrent use.
+func (g *Group) isClosed() bool { return atomic.LoadInt32(&g.closed) != 0 }
+
+// closeCall fails the call if the group is closed and it hasn't started,
+// reporting whether it was failed.
+func (g *Group) closeCall(i int, c *callable) bool {
+	if !g.isClosed() || !c.claim() {
+		return false
+	}
+	c.err = fmt.Errorf("group call %d (%s): closed", i, c.fn.Name())
+	close(c.done)
+	return true
+}
+
+func group_reset(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.reset", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	g.cancel()
+	if s := g.streamer; s != nil {
+		s.wg.Wait()
+		g.streamer = nil
+	}
+	// Calls abandoned by a cancelled parent must finish before reuse.
+	if g.running != nil {
+		<-g.running
+		g.running = nil
+	}
+	g.init()
+	g.calls = nil
+	g.dedupKeys = nil
+	g.results = nil
+	g.elapsed = 0
+	g.err = nil
+	g.frozen = false
+	g.waited = false
+	atomic.StoreInt32(&g.closed, 0)
+	return starlark.None, nil
+}
+
+// group_extend moves the queued calls of the other group to the end of the
+// group, emptying the other group. The calls run with the configuration of the
+// group, futures of the moved calls remain valid.
+func group_extend(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var other *Group
+	if err := starlark.UnpackPositionalArgs("group.extend", args, kwargs, 1, &other); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	switch {
+	case g.frozen:
+		return nil, fmt.Errorf("group.extend: frozen")
+	case g.isClosed():
+		return nil, fmt.Errorf("group.extend: closed")
+	case other.frozen:
+		return nil, fmt.Errorf("group.extend: other group frozen")
+	case other == g:
+		return nil, fmt.Errorf("group.extend: cannot extend a group with itself")
+	}
+	if err := g.checkPending(len(other.calls)); err != nil {
+		return nil, fmt.Errorf("group.extend: %v", err)
+	}
+
+	// Streamed calls of the other group must finish on its workers.
+	if s := other.streamer; s != nil {
+		s.wg.Wait()
+		other.streamer = nil
+	}
+	for _, c := range other.calls {
+		g.calls = append(g.calls, c)
+		c.g, c.i = g, len(g.calls)-1
+		if g.hooks != nil {
+			g.hooks.OnSchedule(len(g.calls) - 1)
+		}
+	}
+	other.calls = nil
+	other.dedupKeys = nil
+	g.drain(thread)
+	return starlark.None, nil
+}
+
+// group_with_value sets the frozen value for the key on the group context,
+// visible to calls with context_value.
+func group_with_value(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		key   string
+		value starlark.Value
+	)
+	if err := starlark.UnpackPositionalArgs("group.with_value", args, kwargs, 2, &key, &value); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.with_value: frozen")
+	}
+	value.Freeze()
+
+	// Set on the parent too so the value survives a reset.
+	g.parent = context.WithValue(g.parent, ContextKey(key), value)
+	g.ctx = context.WithValue(g.ctx, ContextKey(key), value)
+	return starlark.None, nil
+}
+
+// group_flush runs the queued calls returning a tuple of their results, like
+// group_wait, then clears the calls leaving the group open for more calls.
+func group_flush(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.flush", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.flush: frozen")
+	}
+
+	elems, err := g.run(g.ctx, thread, runOptions{
+		failFast: g.failFast,
+		keepCtx:  true,
+	})
+	g.calls = nil
+	g.dedupKeys = nil
+	g.results = nil
+	g.elapsed = 0
+	if err != nil {
+		return nil, err
+	}
+	return elems, nil
+}
+
+// group_stream returns an iterable of the results in order of calling. Calls
+// are executed as the results are consumed, no more than n ahead of the
+// consumer. Failed calls yield an error value, a fail fast group stops after
+// the first.
+func group_stream(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.stream", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.stream: frozen")
+	}
+	g.Freeze()
+	for _, c := range g.calls {
+		c.freeze()
+	}
+	return &resultStream{g: g, e: g.newEnv(g.ctx, thread)}, nil
+}
+
+// group_timings returns a tuple of the call durations in seconds, None for
+// calls that haven't completed.
+func group_timings(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.timings", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	if !g.timings {
+		return nil, fmt.Errorf("group.timings: timings not enabled")
+	}
+
+	elems := make(starlark.Tuple, len(g.calls))
+	for i, c := range g.calls {
+		elems[i] = starlark.None
+		select {
+		case <-c.done:
+			elems[i] = starlark.Float(c.duration.Seconds())
+		default:
+		}
+	}
+	return elems, nil
+}
+
+// group_stats returns a dict of scheduling diagnostics for the completed
+// calls: the number of calls, the total time they waited on the limiter, the
+// time spent waiting for the group and the throughput in calls per second.
+// A limiter wait close to the elapsed time shows the rate limit is the
+// bottleneck.
+func group_stats(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.stats", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+
+	var (
+		calls       int
+		limiterWait time.Duration
+	)
+	for _, c := range g.calls {
+		select {
+		case <-c.done:
+			calls++
+			limiterWait += c.limiterWait
+		default:
+		}
+	}
+	var throughput float64
+	if g.elapsed > 0 {
+		throughput = float64(calls) / g.elapsed.Seconds()
+	}
+
+	d := starlark.NewDict(4)
+	for _, kv := range []struct {
+		key   string
+		value starlark.Value
+	}{
+		{"calls", starlark.MakeInt(calls)},
+		{"limiter_wait", starlarktime.Duration(limiterWait)},
+		{"elapsed", starlarktime.Duration(g.elapsed)},
+		{"throughput", starlark.Float(throughput)},
+	} {
+		if err := d.SetKey(starlark.String(kv.key), kv.value); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// group_limit returns a dict of the rate limit and concurrency of the group.
+// An unlimited rate is reported as "inf".
+func group_limit(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.limit", args, kwargs); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+
+	var (
+		r     starlark.Value = starlark.String("inf")
+		every starlark.Value = starlark.String("inf")
+	)
+	if limit := g.limiter.Limit(); limit != rate.Inf {
+		r = starlark.Float(limit)
+		every = starlarktime.Duration(float64(time.Second) / float64(limit))
+	}
+
+	d := starlark.NewDict(4)
+	for _, kv := range []struct {
+		key   string
+		value starlark.Value
+	}{
+		{"n", starlark.MakeInt(g.n)},
+		{"rate", r},
+		{"every", every},
+		{"burst", starlark.MakeInt(g.limiter.Burst())},
+	} {
+		if err := d.SetKey(starlark.String(kv.key), kv.value); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// group_set_limit updates the rate limit of the group. Changes apply to
+// subsequent calls, including calls already queued or waiting.
+func group_set_limit(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	var (
+		every    starlarktime.Duration
+		burstArg starlark.Value
+	)
+	if err := starlark.UnpackArgs(
+		"group.set_limit", args, kwargs, "every", &every, "burst?", &burstArg,
+	); err != nil {
+		return nil, err
+	}
+	if err := checkEvery(every); err != nil {
+		return nil, fmt.Errorf("group.set_limit: for parameter every: %v", err)
+	}
+	if g.sharedLimiter {
+		return nil, fmt.Errorf("group.set_limit: limiter is shared")
+	}
+
+	// Default to the current burst, or one if rate limited.
+	defaultBurst := g.limiter.Burst()
+	if defaultBurst == 0 && every.Truth() {
+		defaultBurst = 1
+	}
+	burst, err := unpackBurst("group.set_limit", burstArg, defaultBurst)
+	if err != nil {
+		return nil, err
+	}
+	g.limiter.SetLimit(everyLimit(every))
+	g.limiter.SetBurst(burst)
+	return starlark.None, nil
+}
+
+func group_wait(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, g.waitedErr("group.wait")
+	}
+
+	var (
+		raiseErrors bool
+		timeout     starlarktime.Duration
+		onResult    starlark.Callable
+		asList      bool
+		asDict      bool
+		omitErrors  bool
+	)
+	if err := starlark.UnpackArgs(
+		"group.wait", args, kwargs,
+		"raise_errors?", &raiseErrors, "timeout?", &timeout,
+		"on_result?", &onResult, "as_list?", &asList,
+		"as_dict?", &asDict, "omit_errors?", &omitErrors,
+	); err != nil {
+		return nil, err
+	}
+	if asList && asDict {
+		return nil, fmt.Errorf("group.wait: got as_list and as_dict, want one")
+	}
+	g.Freeze()
+
+	ctx := g.ctx
+	if timeout.Truth() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout))
+		defer cancel()
+	}
+
+	opts := runOptions{failFast: g.failFast}
+	if onResult != nil {
+		// Report each result on the waiting thread as it completes.
+		opts.onDone = func(i int, c *callable) (bool, error) {
+			v := c.value
+			if c.err != nil {
+				v = g.errorValue(c.err)
+			}
+			_, err := starlark.Call(thread, onResult, starlark.Tuple{starlark.MakeInt(i), v}, nil)
+			return false, err
+		}
+	}
+
+	elems, err := g.run(ctx, thread, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if raiseErrors {
+		if msgs := callErrors(elems); len(msgs) > 0 {
+			return nil, fmt.Errorf("group.wait: %d of %d calls failed: %s",
+				len(msgs), len(elems), strings.Join(msgs, "; "))
+		}
+	}
+	calls := elems
+	elems = g.results // Flattened with defaults.
+	for _, fn := range g.onComplete {
+		if _, err := starlark.Call(thread, fn, starlark.Tuple{elems}, nil); err != nil {
+			return nil, err
+		}
+	}
+	if asList {
+		return starlark.NewList(append([]starlark.Value(nil), elems...)), nil
+	}
+	if asDict {
+		d := starlark.NewDict(len(calls))
+		for i, v := range calls {
+			if e, ok := v.(callError); ok {
+				if omitErrors {
+					continue
+				}
+				v = g.errorValue(e.err)
+			}
+			if err := d.SetKey(starlark.MakeInt(i), nested(v)); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+	return elems, nil
+}
+
+// group_on_complete registers a function that wait calls with the results
+// once all calls complete successfully. It runs on the waiting thread so may
+// safely update state shared with it.
+func group_on_complete(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var fn starlark.Callable
+	if err := starlark.UnpackPositionalArgs("group.on_complete", args, kwargs, 1, &fn); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.on_complete: frozen")
+	}
+	g.onComplete = append(g.onComplete, fn)
+	return starlark.None, nil
+}
+
+// group_sorted returns a list of the results sorted like the sorted builtin,
+// waiting for the group if needed.
+func group_sorted(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		key     starlark.Callable
+		reverse bool
+	)
+	if err := starlark.UnpackArgs("group.sorted", args, kwargs,
+		"key?", &key, "reverse?", &reverse,
+	); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	elems, err := g.resultsOn(thread, "group.sorted")
+	if err != nil {
+		return nil, err
+	}
+
+	sortKwargs := []starlark.Tuple{{starlark.String("reverse"), starlark.Bool(reverse)}}
+	if key != nil {
+		sortKwargs = append(sortKwargs, starlark.Tuple{starlark.String("key"), key})
+	}
+	return starlark.Call(thread, starlark.Universe["sorted"], starlark.Tuple{elems}, sortKwargs)
+}
+
+// group_filter returns a tuple of the results for which the predicate is
+// true, in order of calling, waiting for the group if needed.
+func group_filter(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var predicate starlark.Callable
+	if err := starlark.UnpackPositionalArgs("group.filter", args, kwargs, 1, &predicate); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	elems, err := g.resultsOn(thread, "group.filter")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(starlark.Tuple, 0, len(elems))
+	for _, v := range elems {
+		ok, err := starlark.Call(thread, predicate, starlark.Tuple{v}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ok.Truth() {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+// group_reduce folds the results in order of calling with fn(acc, result),
+// starting from the initial value, waiting for the group if needed. The fold
+// runs on the calling thread.
+func group_reduce(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		fn  starlark.Callable
+		acc starlark.Value
+	)
+	if err := starlark.UnpackPositionalArgs("group.reduce", args, kwargs, 2, &fn, &acc); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	elems, err := g.resultsOn(thread, "group.reduce")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range elems {
+		if acc, err = starlark.Call(thread, fn, starlark.Tuple{acc, v}, nil); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// flatten replaces the groups returned by calls with their results, depth
+// first in order of calling.
+func flatten(elems starlark.Tuple) starlark.Tuple {
+	nested := false
+	for _, v := range elems {
+		if _, ok := v.(*Group); ok {
+			nested = true
+			break
+		}
+	}
+	if !nested {
+		return elems
+	}
+	flat := make(starlark.Tuple, 0, len(elems))
+	for _, v := range elems {
+		if sub, ok := v.(*Group); ok {
+			flat = append(flat, flatten(sub.results)...)
+			continue
+		}
+		flat = append(flat, v)
+	}
+	return flat
+}
+
+// nested returns the tuple of the flattened results of a nested group in the
+// slot of its call, or the value.
+func nested(v starlark.Value) starlark.Value {
+	if sub, ok := v.(*Group); ok {
+		return flatten(sub.results)
+	}
+	return v
+}
+
+// callErrors returns the messages of the failed calls in the results.
+func callErrors(elems starlark.Tuple) []string {
+	var msgs []string
+	for _, v := range elems {
+		if e, ok := v.(callError); ok {
+			msgs = append(msgs, e.err.Error())
+		}
+	}
+	return msgs
+}
+
+// errorValue returns the value of a failed call in the results, the default
+// of a group that doesn't fail fast.
+func (g *Group) errorValue(err error) starlark.Value {
+	if g.fallback != nil && !g.failFast {
+		return g.fallback
+	}
+	return callError{err: err}
+}
+
+// withDefault returns the results with the error values replaced by the
+// default, copying the results if any are replaced.
+func (g *Group) withDefault(elems starlark.Tuple) starlark.Tuple {
+	if g.fallback == nil {
+		return elems
+	}
+	var filled starlark.Tuple
+	for i, v := range elems {
+		if _, ok := v.(callError); !ok {
+			continue
+		}
+		if filled == nil {
+			filled = append(starlark.Tuple(nil), elems...)
+		}
+		filled[i] = g.fallback
+	}
+	if filled == nil {
+		return elems
+	}
+	return filled
+}
+
+// group_wait_any runs the queued calls returning the first successful result
+// and cancelling the remaining calls. Errors are only reported if all calls
+// fail.
+func group_wait_any(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.wait_any: frozen")
+	}
+
+	if err := starlark.UnpackArgs("group.wait_any", args, kwargs); err != nil {
+		return nil, err
+	}
+	if len(g.calls) == 0 {
+		return nil, fmt.Errorf("group.wait_any: no calls")
+	}
+	g.Freeze()
+
+	var first starlark.Value
+	elems, err := g.run(g.ctx, thread, runOptions{
+		onDone: func(_ int, c *callable) (bool, error) {
+			if c.err != nil {
+				return false, nil
+			}
+			first = c.value
+			return true, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		msgs := callErrors(elems)
+		return nil, fmt.Errorf("group.wait_any: all %d calls failed: %s",
+			len(msgs), strings.Join(msgs, "; "))
+	}
+	return first, nil
+}
+
+// group_wait_n runs the queued calls returning a tuple of the first k
+// successful results and cancelling the remaining calls. Unlike group_wait the
+// results are in order of completion, not in order of calling. K must be at
+// least one.
+func group_wait_n(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.wait_n: frozen")
+	}
+
+	var k int
+	if err := starlark.UnpackPositionalArgs("group.wait_n", args, kwargs, 1, &k); err != nil {
+		return nil, err
+	}
+	if k < 1 || k > len(g.calls) {
+		return nil, fmt.Errorf("group.wait_n: got k=%d, want between 1 and %d calls", k, len(g.calls))
+	}
+	g.Freeze()
+
+	vals := make(starlark.Tuple, 0, k)
+	elems, err := g.run(g.ctx, thread, runOptions{
+		onDone: func(_ int, c *callable) (bool, error) {
+			if c.err != nil {
+				return false, nil
+			}
+			vals = append(vals, c.value)
+			return len(vals) == k, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) < k {
+		msgs := callErrors(elems)
+		return nil, fmt.Errorf("group.wait_n: got %d of %d results, %d calls failed: %s",
+			len(vals), k, len(msgs), strings.Join(msgs, "; "))
+	}
+	return vals, nil
+}
+
+// call calls the callable on the thread, rate limiting each attempt and
+// retrying on error. Panics are recovered as errors holding the Starlark call
+// stack at the panic and the Go stack. Errors of Starlark calls wrap the
+// *starlark.EvalError, its Backtrace has the Starlark call stack.
+func (g *Group) call(ctx context.Context, thread *starlark.Thread, c *callable) (starlark.Value, error) {
+	return recoverCall(thread, func() (starlark.Value, error) {
+		return g.callRetry(ctx, thread, c)
+	})
+}
+
+// recoverCall calls fn recovering panics as errors holding the Starlark call
+// stack at the panic and the Go stack.
+func recoverCall(thread *starlark.Thread, fn func() (starlark.Value, error)) (_ starlark.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s\n%s", r, thread.CallStack(), debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+// callRetry calls the callable rate limiting each attempt and retrying on
+// error.
+func (g *Group) callRetry(ctx context.Context, thread *starlark.Thread, c *callable) (starlark.Value, error) {
+	cost := c.cost
+	if cost == 0 {
+		cost = 1
+	}
+	for attempt := 0; ; attempt++ {
+		waitStart := time.Now()
+		err := g.limiter.WaitN(ctx, cost)
+		c.limiterWait += time.Since(waitStart)
+		if err != nil {
+			return nil, err
+		}
+		if d := g.jitterDelay(); d > 0 && !sleepContext(ctx, d) {
+			return nil, ctx.Err()
+		}
+		if attempt == 0 && g.isClosed() {
+			return nil, errClosed // Closed while waiting on the limiter.
+		}
+		v, err := g.callOnce(ctx, thread, c)
+		if err == nil || attempt >= g.retries || ctx.Err() != nil {
+			return v, err
+		}
+
+		if d := g.backoffDelay(attempt); d > 0 && !sleepContext(ctx, d) {
+			return v, err
+		}
+	}
+}
+
+// cacheGet returns the cached result for the key.
+func (g *Group) cacheGet(key starlark.String) (starlark.Value, bool, error) {
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	return g.cache.Get(key)
+}
+
+// cacheSet caches the frozen result for the key.
+func (g *Group) cacheSet(key starlark.String, v starlark.Value) error {
+	v.Freeze()
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	return g.cache.SetKey(key, v)
+}
+
+// produceArgs appends the frozen args returned by the arg function of the call
+// to its args.
+func (g *Group) produceArgs(thread *starlark.Thread, c *callable) error {
+	if c.argFn == nil {
+		return nil
+	}
+	v, err := recoverCall(thread, func() (starlark.Value, error) {
+		return starlark.Call(thread, c.argFn, nil, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("arg_fn: %w", err)
+	}
+	args, ok := v.(starlark.Tuple)
+	if !ok {
+		return fmt.Errorf("arg_fn: got %s, want tuple", v.Type())
+	}
+	args.Freeze()
+	c.args = append(c.args[:len(c.args):len(c.args)], args...)
+	return nil
+}
+
+// callOnce calls fn holding a unit of the shared semaphore, if set.
+func (g *Group) callOnce(ctx context.Context, thread *starlark.Thread, c *callable) (starlark.Value, error) {
+	if g.sem != nil {
+		if err := g.sem.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		defer g.sem.Release(1)
+	}
+	start := time.Now()
+	v, err := starlark.Call(thread, c.fn, c.args, c.kwargs)
+	if g.timings || g.slowThreshold > 0 {
+		c.duration += time.Since(start)
+	}
+	return v, err
+}
+
+// sleepContext sleeps for the duration reporting false if the context is done
+// first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// jitterDelay returns a random delay in [0, jitter].
+func (g *Group) jitterDelay() time.Duration {
+	if g.jitter <= 0 {
+		return 0
+	}
+	g.randMu.Lock()
+	defer g.randMu.Unlock()
+	if g.rand == nil {
+		g.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(g.rand.Int63n(int64(g.jitter) + 1))
+}
+
+// SetRand sets the source of jitter delays, defaulting to a time seeded
+// source. The source is only used by one call at a time.
+func (g *Group) SetRand(r *rand.Rand) {
+	g.randMu.Lock()
+	defer g.randMu.Unlock()
+	g.rand = r
+}
+
+// backoffDelay returns the delay before retrying after the attempt, doubling
+// the backoff for each attempt up to the max backoff.
+func (g *Group) backoffDelay(attempt int) time.Duration {
+	d := g.backoff
+	for i := 0; i < attempt && d < math.MaxInt64/2; i++ {
+		if g.backoffMax > 0 && d >= g.backoffMax {
+			break
+		}
+		d *= 2
+	}
+	if g.backoffMax > 0 && d > g.backoffMax {
+		d = g.backoffMax
+	}
+	return d
+}
+
+// group_stop returns a sentinel that stops the wait when returned by a call of
+// the group. The remaining calls are cancelled and the result of the call is
+// the value.
+func group_stop(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var value starlark.Value = starlark.None
+	if err := starlark.UnpackArgs("group.stop", args, kwargs, "value?", &value); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Group)
+	return &stopValue{g: g, value: value}, nil
+}
+
+// stopValue is the sentinel returned by group.stop.
+type stopValue struct {
+	g     *Group
+	value starlark.Value
+}
+
+func (s *stopValue) String() string        { return fmt.Sprintf("stop(%s)", s.value) }
+func (s *stopValue) Type() string          { return "group.stop" }
+func (s *stopValue) Freeze()               { s.value.Freeze() }
+func (s *stopValue) Truth() starlark.Bool  { return starlark.True }
+func (s *stopValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: group.stop") }
+
+// group_wait_grouped waits like group_wait but returns a dict of the results
+// by the key of their calls, in order of calling. Calls without a key are under
+// None.
+func group_wait_grouped(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.wait_grouped: frozen")
+	}
+
+	if err := starlark.UnpackArgs("group.wait_grouped", args, kwargs); err != nil {
+		return nil, err
+	}
+	g.Freeze()
+
+	elems, err := g.run(g.ctx, thread, runOptions{failFast: g.failFast})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		keys    []starlark.Value
+		buckets = make(map[starlark.Value]starlark.Tuple)
+	)
+	for i, c := range g.calls {
+		var key starlark.Value = starlark.None
+		if c.key != "" {
+			key = c.key
+		}
+		if _, ok := buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+		buckets[key] = append(buckets[key], nested(elems[i]))
+	}
+	d := starlark.NewDict(len(keys))
+	for _, key := range keys {
+		if err := d.SetKey(key, buckets[key]); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// group_wait_partial waits like group_wait but returns a tuple of the results
+// and the error message, or None. Results of calls that didn't complete are
+// None.
+func group_wait_partial(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.wait_partial: frozen")
+	}
+
+	if err := starlark.UnpackArgs("group.wait_partial", args, kwargs); err != nil {
+		return nil, err
+	}
+	g.Freeze()
+
+	elems, err := g.run(g.ctx, thread, runOptions{failFast: g.failFast})
+	var msg starlark.Value = starlark.None
+	if err != nil {
+		msg = starlark.String(err.Error())
+	}
+	return starlark.Tuple{flatten(elems), msg}, nil
+}
+
+// group_collect runs every queued call like group_wait with fail_fast=False,
+// returning a result separating the values from the errors.
+func group_collect(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	g := b.Receiver().(*Group)
+	if g.frozen {
+		return nil, fmt.Errorf("group.collect: frozen")
+	}
+
+	if err := starlark.UnpackArgs("group.collect", args, kwargs); err != nil {
+		return nil, err
+	}
+	g.Freeze()
+
+	elems, err := g.run(g.ctx, thread, runOptions{failFast: false})
+	if err != nil {
+		return nil, err
+	}
+	elems = flatten(elems)
+
+	res := &result{
+		values: make(starlark.Tuple, len(elems)),
+		errors: make(starlark.Tuple, len(elems)),
+	}
+	for i, v := range elems {
+		res.values[i], res.errors[i] = v, starlark.None
+		if e, ok := v.(callError); ok {
+			res.values[i], res.errors[i] = starlark.None, starlark.String(e.err.Error())
+		}
+	}
+	return res, nil
+}
+
+// resultStream is the iterable of group.stream. Iterating the stream again
+// continues after the last result consumed.
+type resultStream struct {
+	g    *Group
+	e    *env
+	wg   sync.WaitGroup
+	next int // index of the next result
+	run  int // index of the next call to start
+	done bool
+}
+
+func (s *resultStream) String() string             { return fmt.Sprintf("stream(%s)", s.g.name) }
+func (s *resultStream) Type() string               { return "group.stream" }
+func (s *resultStream) Freeze()                    {}
+func (s *resultStream) Truth() starlark.Bool       { return starlark.True }
+func (s *resultStream) Hash() (uint32, error)      { return 0, fmt.Errorf("unhashable type: group.stream") }
+func (s *resultStream) Iterate() starlark.Iterator { return s }
+
+// start runs the calls up to and including the i-th call.
+func (s *resultStream) start(i int) {
+	g := s.g
+	for ; s.run <= i && s.run < len(g.calls); s.run++ {
+		i, c := s.run, g.calls[s.run]
+		if g.closeCall(i, c) {
+			continue
+		}
+		if !c.claim() {
+			continue // Started by its future.
+		}
+		if g.serial {
+			g.execute(s.e, i, c)
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			g.execute(s.e, i, c)
+		}()
+	}
+}
+
+func (s *resultStream) Next(p *starlark.Value) bool {
+	g := s.g
+	if s.done || s.next >= len(g.calls) {
+		if !s.done {
+			s.done = true
+			g.cancel()
+		}
+		return false
+	}
+	i, c := s.next, g.calls[s.next]
+	s.next++
+
+	// Run ahead of the consumer bounded by n.
+	ahead := len(g.calls)
+	if g.n > 0 {
+		ahead = g.n
+	}
+	if g.serial {
+		ahead = 1
+	}
+	s.start(i + ahead - 1)
+	<-c.done
+
+	if c.err != nil {
+		*p = g.errorValue(c.err)
+		if g.failFast {
+			s.done = true
+			g.cancel()
+		}
+		return true
+	}
+	if c.stop {
+		s.done = true
+		g.cancel()
+	}
+	*p = c.value
+	return true
+}
+
+// Done waits for the calls started ahead of the consumer.
+func (s *resultStream) Done() { s.wg.Wait() }
+
+// result is the outcome of collecting a group, values holds the results in
+// order of calling with None for failed calls and errors holds the error
+// messages of failed calls with None for successful calls.
+type result struct {
+	values starlark.Tuple
+	errors starlark.Tuple
+}
+
+func (r *result) String() string {
+	return fmt.Sprintf("result(values=%s, errors=%s)", r.values, r.errors)
+}
+func (r *result) Type() string          { return "group.result" }
+func (r *result) Freeze()               { r.values.Freeze(); r.errors.Freeze() }
+func (r *result) Truth() starlark.Bool  { return starlark.True }
+func (r *result) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: group.result") }
+
+func (r *result) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "values":
+		return r.values, nil
+	case "errors":
+		return r.errors, nil
+	}
+	return nil, nil
+}
+
+func (r *result) AttrNames() []string { return []string{"errors", "values"} }
+
+// env is the environment of the threads calls are executed on.
+type env struct {
+	ctx    context.Context
+	print  func(thread *starlark.Thread, msg string)
+	load   func(thread *starlark.Thread, module string) (starlark.StringDict, error)
+	locals map[string]interface{}
+}
+
+// printf prints the message with the print function of the waiting thread,
+// or to stderr like the Starlark print builtin.
+func (e *env) printf(thread *starlark.Thread, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if e.print != nil {
+		e.print(thread, msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// newEnv returns the environment for calls spawned from the thread. Print and
+// Load of the thread are serialized as calls run concurrently.
+func (g *Group) newEnv(ctx context.Context, thread *starlark.Thread) *env {
+	e := &env{ctx: ctx}
+
+	var mu sync.Mutex
+	if thread.Print != nil {
+		e.print = func(goThread *starlark.Thread, msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			thread.Print(goThread, msg)
+		}
+	}
+	if thread.Load != nil {
+		e.load = func(goThread *starlark.Thread, module string) (starlark.StringDict, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return thread.Load(goThread, module)
+		}
+	}
+
+	e.locals = make(map[string]interface{}, len(g.locals))
+	for _, key := range g.locals {
+		e.locals[key] = thread.Local(key)
+	}
+	return e
+}
+
+// execute runs the i-th call on a new thread storing the result. The call
+// must have been claimed.
+func (g *Group) execute(e *env, i int, c *callable) {
+	defer close(c.done)
+
+	// Copy the result of the duplicated call, running it if it hasn't started.
+	if d := c.dup; d != nil {
+		if d.c.claim() {
+			d.c.freeze()
+			g.execute(e, d.c.i, d.c)
+		}
+		<-d.c.done
+		c.value, c.err, c.stop = d.c.value, d.c.err, d.c.stop
+		return
+	}
+
+	// Run the dependency first if it hasn't started, keeping the slot.
+	if a := c.after; a != nil {
+		if a.c.claim() {
+			a.c.freeze()
+			g.execute(e, a.c.i, a.c)
+		}
+		<-a.c.done
+		if a.c.err != nil {
+			c.err = fmt.Errorf("group call %d (%s): after call %d failed", i, c.fn.Name(), a.c.i)
+			return
+		}
+	}
+
+	cached := g.cache != nil && c.cacheKey != ""
+	if cached {
+		v, found, err := g.cacheGet(c.cacheKey)
+		if err != nil {
+			c.err = fmt.Errorf("group call %d (%s): cache: %w", i, c.fn.Name(), err)
+			return
+		}
+		if found {
+			c.value = v
+			return
+		}
+	}
+
+	ctx := e.ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	endSpan := func(error) {}
+	if g.startSpan != nil {
+		ctx, endSpan = g.startSpan(ctx, c.fn.Name())
+	}
+	thread := &starlark.Thread{
+		Name:  fmt.Sprintf("%s[%d]", g.name, i),
+		Print: e.print,
+		Load:  e.load,
+	}
+	for key, value := range e.locals {
+		thread.SetLocal(key, value)
+	}
+	thread.SetLocal("context", ctx)
+	if steps := c.maxSteps; steps > 0 {
+		thread.SetMaxExecutionSteps(steps)
+	} else if g.maxSteps > 0 {
+		thread.SetMaxExecutionSteps(g.maxSteps)
+	}
+	if g.config != nil {
+		thread.SetLocal(ConfigKey, g.config)
+	}
+
+	// Cancel the thread if the context is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-stop:
+		}
+	}()
+
+	if g.hooks != nil {
+		g.hooks.OnStart(i)
+	}
+	var v starlark.Value
+	err := g.produceArgs(thread, c)
+	if err == nil {
+		v, err = g.call(ctx, thread, c)
+	}
+	// Only time in the function counts, not waiting on the limiter.
+	if d := c.duration; g.slowThreshold > 0 && d > g.slowThreshold {
+		e.printf(thread, "group call %d (%s) slow: took %s", i, c.fn.Name(), d)
+	}
+	if sub, ok := v.(*Group); ok && err == nil && sub != g && !sub.frozen {
+		// Wait a nested group while the call context is live.
+		_, err = sub.Wait(thread)
+	}
+	if err != nil {
+		err = fmt.Errorf("group call %d (%s): %w", i, c.fn.Name(), err)
+	}
+	if err != nil && c.onError != nil && !errors.Is(err, errClosed) {
+		// The handler result replaces the error.
+		args := starlark.Tuple{starlark.String(err.Error())}
+		v, err = recoverCall(thread, func() (starlark.Value, error) {
+			return starlark.Call(thread, c.onError, args, nil)
+		})
+		if err != nil {
+			err = fmt.Errorf("group call %d (%s): on_error: %w", i, c.fn.Name(), err)
+		}
+	}
+	if s, ok := v.(*stopValue); ok && s.g == g {
+		v, c.stop = s.value, true
+	}
+	if cached && err == nil {
+		if err = g.cacheSet(c.cacheKey, v); err != nil {
+			err = fmt.Errorf("group call %d (%s): cache: %w", i, c.fn.Name(), err)
+		}
+	}
+	c.value, c.err = v, err
+	endSpan(err)
+	if g.hooks != nil {
+		g.hooks.OnComplete(i, err)
+	}
+}
+
+// runOptions configure a run of the queued calls.
+type runOptions struct {
+	// failFast cancels the run on the first error.
+	failFast bool
+
+	// onDone is called on the waiting goroutine as each call completes, in
+	// order of completion. Returning true stops the run cancelling any
+	// remaining calls.
+	onDone func(i int, c *callable) (stop bool, err error)
+
+	// keepCtx leaves the group context uncancelled after the run.
+	keepCtx bool
+}
+
+// run executes the queued calls returning the results in order of calling.
+// The wait context bounds the run, it must be derived from the group context.
+// On error the results of the calls that completed are still returned.
+func (g *Group) run(waitCtx context.Context, thread *starlark.Thread, opts runOptions) (starlark.Tuple, error) {
+	if !opts.keepCtx {
+		defer g.cancel()
+	}
+	runCtx, stopRun := context.WithCancel(waitCtx)
+	defer stopRun()
+	atomic.AddInt32(&g.runs, 1)
+	defer func() {
+		if atomic.AddInt32(&g.runs, -1) == 0 && g.isClosed() {
+			g.StopWorkers()
+		}
+	}()
+	group, ctx := errgroup.WithContext(runCtx)
+	e := g.newEnv(ctx, thread)
+	g.waited = g.frozen
+	if g.waited {
+		defer close(g.waitDone)
+	}
+	start := time.Now()
+	defer func() { g.elapsed += time.Since(start) }()
+
+	// Workers abandoned by a cancelled parent may outlive the run, they only
+	// see the calls of this run.
+	calls := g.calls
+
+	// Freeze all calls before any run, futures may start calls early.
+	for _, c := range calls {
+		c.freeze()
+	}
+	// Wait for streamed calls to keep running calls bounded by n.
+	var streamErr error
+	if s := g.streamer; s != nil {
+		s.wg.Wait()
+		streamErr = s.err
+		g.streamer = nil
+	}
+
+	completed := make(chan int, len(calls))
+	call := func(i int) error {
+		c := calls[i]
+		if g.closeCall(i, c) {
+			completed <- i
+			return nil
+		}
+		if !c.claim() {
+			return nil // Started by its future.
+		}
+		g.execute(e, i, c)
+		if c.stop {
+			stopRun()
+		}
+		completed <- i
+		if c.err != nil && opts.failFast {
+			return c.err
+		}
+		return nil
+	}
+
+	var (
+		err      error
+		stopped  bool
+		reported = make([]bool, len(calls))
+	)
+	report := func(i int) {
+		reported[i] = true
+		if stopped || err != nil {
+			return
+		}
+		if calls[i].stop {
+			stopped = true
+			stopRun()
+			return
+		}
+		if opts.onDone == nil {
+			return
+		}
+		stop, doneErr := opts.onDone(i, calls[i])
+		if doneErr != nil {
+			err = doneErr
+			stopRun()
+		} else if stop {
+			stopped = true
+			stopRun()
+		}
+	}
+
+	// Calls completed by their future before the run.
+	for i, c := range calls {
+		select {
+		case <-c.done:
+			report(i)
+		default:
+		}
+	}
+
+	groupErr := make(chan error, 1)
+	if g.serial {
+		// Run each call in order of calling on the waiting goroutine.
+		var serialErr error
+		for i := range calls {
+			if serialErr = ctx.Err(); serialErr != nil {
+				break
+			}
+			if serialErr = call(i); serialErr != nil {
+				break
+			}
+			for len(completed) > 0 {
+				report(<-completed)
+			}
+		}
+		groupErr <- serialErr
+		close(completed)
+	} else {
+		g.dispatch(ctx, group, calls, call, stopRun)
+		running := make(chan struct{})
+		g.running = running
+		go func() {
+			groupErr <- group.Wait()
+			close(completed)
+			close(running)
+		}()
+	}
+
+	// Report calls as they complete. Once the parent context is done running
+	// calls are abandoned rather than waited for, they are cancelled with
+	// the group.
+	abandoned := false
+	for reporting := true; reporting; {
+		select {
+		case i, ok := <-completed:
+			if !ok {
+				reporting = false
+				break
+			}
+			report(i)
+		case <-g.parent.Done():
+			abandoned, reporting = true, false
+		}
+	}
+	// Calls completed by their future during the run.
+	for i, c := range calls {
+		select {
+		case <-c.done:
+			if !reported[i] {
+				report(i)
+			}
+		default:
+		}
+	}
+
+	// Wait for all running calls before returning partial results.
+	if abandoned {
+		// Running calls are left to finish with the cancelled group.
+	} else if e := <-groupErr; err == nil && !stopped {
+		err = e
+	}
+	if streamErr != nil && !stopped {
+		err = streamErr // Cancelled the group.
+	}
+	if err == nil && !stopped {
+		err = waitCtx.Err()
+	}
+
+	// Slots are None unless filled, the tuple never holds a nil value.
+	elems := make(starlark.Tuple, len(calls))
+	for i, c := range calls {
+		elems[i] = starlark.None
+		if c.claim() {
+			c.err = fmt.Errorf("group call %d (%s): not run", i, c.fn.Name())
+			close(c.done)
+		}
+		if abandoned {
+			select {
+			case <-c.done:
+			default:
+				if !opts.failFast {
+					elems[i] = callError{err: fmt.Errorf("group call %d (%s): %w", i, c.fn.Name(), g.parent.Err())}
+				}
+				continue
+			}
+		}
+		<-c.done
+
+		switch {
+		case c.err == nil:
+			elems[i] = c.value
+		case !opts.failFast:
+			elems[i] = callError{err: c.err}
+		case err == nil && !stopped:
+			err = c.err // Failed before the run.
+		}
+	}
+	if err != nil {
+		return elems, err
+	}
+	g.results = g.withDefault(flatten(elems))
+	return elems, nil
+}
+
+// dispatchOrder returns the call indexes by descending priority, stable in
+// order of calling or reverse order of calling if lifo. Calls of equal
+// priority take turns between keys in order of the first call of each key,
+// the weight of the next call of a key sets the calls taken per turn.
+func (g *Group) dispatchOrder(calls []*callable) []int {
+	order := make([]int, len(calls))
+	for i := range order {
+		order[i] = i
+		if g.lifo {
+			order[i] = len(order) - 1 - i
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return calls[order[a]].priority > calls[order[b]].priority
+	})
+
+	for lo := 0; lo < len(order); {
+		hi := lo + 1
+		for hi < len(order) && calls[order[hi]].priority == calls[order[lo]].priority {
+			hi++
+		}
+
+		var keys []starlark.String
+		byKey := make(map[starlark.String][]int)
+		for _, i := range order[lo:hi] {
+			key := calls[i].key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], i)
+		}
+		if len(keys) > 1 {
+			turns := make([]int, 0, hi-lo)
+			for len(turns) < hi-lo {
+				for _, key := range keys {
+					next := byKey[key]
+					if len(next) == 0 {
+						continue
+					}
+					n := calls[next[0]].weight
+					if n < 1 {
+						n = 1
+					}
+					if n > len(next) {
+						n = len(next)
+					}
+					turns = append(turns, next[:n]...)
+					byKey[key] = next[n:]
+				}
+			}
+			copy(order[lo:hi], turns)
+		}
+		lo = hi
+	}
+	return order
+}
+
+// dispatch starts the calls on the errgroup, bounded by n workers. The stop
+// function cancels the run.
+func (g *Group) dispatch(ctx context.Context, group *errgroup.Group, calls []*callable, call func(int) error, stop func()) {
+	g.workersMu.Lock()
+	if g.reuseWorkers && g.n > 0 && g.workers == nil {
+		g.workers = g.startWorkers()
+	}
+	w := g.workers
+	g.workersMu.Unlock()
+
+	group.Go(func() error {
+		if g.n <= 0 {
+			for i := range calls {
+				i := i
+				group.Go(func() error { return call(i) })
+			}
+			return nil
+		}
+
+		order := g.dispatchOrder(calls)
+
+		if w != nil {
+			return w.dispatch(ctx, order, call, stop)
+		}
+
+		queue := make(chan int, g.n)
+		defer close(queue)
+		for i := 0; i < g.n && i < len(calls); i++ {
+			group.Go(func() error {
+				for i := range queue {
+					if err := call(i); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		for _, i := range order {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// future is the handle to a call returned by group.go.
+type future struct {
+	c *callable
+}
+
+func (f *future) String() string        { return fmt.Sprintf("future(%s[%d])", f.c.g.name, f.c.i) }
+func (f *future) Type() string          { return "group.future" }
+func (f *future) Freeze()               {}
+func (f *future) Truth() starlark.Bool  { return starlark.True }
+func (f *future) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: group.future") }
+
+var futureMethods = map[string]*starlark.Builtin{
+	"result": starlark.NewBuiltin("group.future.result", future_result),
+}
+
+func (f *future) Attr(name string) (starlark.Value, error) {
+	b := futureMethods[name]
+	if b == nil {
+		return nil, nil
+	}
+	return b.BindReceiver(f), nil
+}
+
+func (f *future) AttrNames() []string {
+	names := make([]string, 0, len(futureMethods))
+	for name := range futureMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// start executes the call on the thread if it hasn't been started.
+func (f *future) start(thread *starlark.Thread) {
+	if f.c.claim() {
+		f.c.freeze()
+		g := f.c.g
+		g.execute(g.newEnv(g.ctx, thread), f.c.i, f.c)
+	}
+}
+
+// future_result returns the result of the call, blocking until it completes.
+// A call that hasn't started is executed on the calling thread.
+func future_result(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs("group.future.result", args, kwargs); err != nil {
+		return nil, err
+	}
+	f := b.Receiver().(*future)
+	f.start(thread)
+	<-f.c.done
+	if f.c.err != nil {
+		return nil, f.c.err
+	}
+	return f.c.value, nil
 }
@@ -5,19 +5,1180 @@
 package starlarkgroup
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/emcfarlane/starlarkassert"
+	starlarktime "go.starlark.net/lib/time"
 	"go.starlark.net/starlark"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
+// counter is a concurrency safe counter for observing calls from Starlark.
+type counter struct {
+	mu  sync.Mutex
+	val int
+	max int
+}
+
+func (c *counter) String() string        { return "counter()" }
+func (c *counter) Type() string          { return "counter" }
+func (c *counter) Freeze()               {}
+func (c *counter) Truth() starlark.Bool  { return starlark.True }
+func (c *counter) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: counter") }
+
+var counterMethods = map[string]*starlark.Builtin{
+	"inc": starlark.NewBuiltin("counter.inc", counter_inc),
+	"dec": starlark.NewBuiltin("counter.dec", counter_dec),
+}
+
+func (c *counter) Attr(name string) (starlark.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch name {
+	case "value":
+		return starlark.MakeInt(c.val), nil
+	case "max":
+		return starlark.MakeInt(c.max), nil
+	}
+	b := counterMethods[name]
+	if b == nil {
+		return nil, nil
+	}
+	return b.BindReceiver(c), nil
+}
+
+func (c *counter) AttrNames() []string {
+	names := []string{"max", "value"}
+	for name := range counterMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func counter_inc(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	c := b.Receiver().(*counter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.val++
+	if c.val > c.max {
+		c.max = c.val
+	}
+	return starlark.MakeInt(c.val), nil
+}
+
+func counter_dec(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	c := b.Receiver().(*counter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.val--
+	return starlark.MakeInt(c.val), nil
+}
+
+func makeCounter(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return &counter{}, nil
+}
+
+func sleep(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var d starlarktime.Duration
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "d", &d); err != nil {
+		return nil, err
+	}
+	time.Sleep(time.Duration(d))
+	return starlark.None, nil
+}
+
+func threadName(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlark.String(thread.Name), nil
+}
+
+// goroutineID returns the ID of the current goroutine from its stack trace.
+func goroutineID(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// "goroutine 123 [running]: ..."
+	id := strings.Fields(string(buf))[1]
+	return starlark.String(id), nil
+}
+
+func setLocal(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		key   string
+		value starlark.Value
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "value", &value); err != nil {
+		return nil, err
+	}
+	thread.SetLocal(key, value)
+	return starlark.None, nil
+}
+
+func getLocal(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key); err != nil {
+		return nil, err
+	}
+	if v, ok := thread.Local(key).(starlark.Value); ok {
+		return v, nil
+	}
+	return starlark.None, nil
+}
+
 func TestExecFile(t *testing.T) {
 	runner := func(thread *starlark.Thread, test func()) {
 		t.Logf("%s", thread.Name)
 		test()
 	}
 	globals := starlark.StringDict{
-		"group": starlark.NewBuiltin("group", Make),
+		"group":         starlark.NewBuiltin("group", Make),
+		"counter":       starlark.NewBuiltin("counter", makeCounter),
+		"sleep":         starlark.NewBuiltin("sleep", sleep),
+		"time":          starlarktime.Module,
+		"config":        starlark.NewBuiltin("config", Config),
+		"sleep_context": starlark.NewBuiltin("sleep_context", Sleep),
+		"context_value": starlark.NewBuiltin("context_value", ContextValue),
+
+		"thread_name":  starlark.NewBuiltin("thread_name", threadName),
+		"goroutine_id": starlark.NewBuiltin("goroutine_id", goroutineID),
+		"set_local":    starlark.NewBuiltin("set_local", setLocal),
+		"get_local":    starlark.NewBuiltin("get_local", getLocal),
 	}
 	starlarkassert.RunTests(t, "testdata/*.star", globals, runner)
 }
+
+func TestPrint(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		msgs []string
+	)
+	thread := &starlark.Thread{
+		Name: "main",
+		Print: func(_ *starlark.Thread, msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			msgs = append(msgs, msg)
+		},
+	}
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+	}
+	src := `
+def hello(i):
+    print("hello", i)
+
+g = group()
+g.map(hello, range(10))
+g.wait()
+`
+	if _, err := starlark.ExecFile(thread, "print.star", src, globals); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(msgs)
+	want := []string{
+		"hello 0", "hello 1", "hello 2", "hello 3", "hello 4",
+		"hello 5", "hello 6", "hello 7", "hello 8", "hello 9",
+	}
+	if fmt.Sprint(msgs) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", msgs, want)
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		msgs []string
+	)
+	thread := &starlark.Thread{
+		Name: "main",
+		Print: func(_ *starlark.Thread, msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			msgs = append(msgs, msg)
+		},
+	}
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+		"sleep": starlark.NewBuiltin("sleep", sleep),
+	}
+	src := `
+g = group(slow_threshold = "20ms")
+g.go(sleep, "0s")
+g.go(sleep, "50ms")
+g.go(sleep, "0s")
+g.wait()
+`
+	if _, err := starlark.ExecFile(thread, "slow.star", src, globals); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0], "group call 1 (sleep) slow: took ") {
+		t.Errorf("got %q, want one slow call report", msgs)
+	}
+
+	// Waiting on the rate limiter isn't slow.
+	msgs = nil
+	src = `
+g = group(n = 1, every = "50ms", slow_threshold = "20ms")
+g.map(sleep, ["0s"] * 3)
+g.wait()
+`
+	if _, err := starlark.ExecFile(thread, "slow.star", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("got %q, want no slow call reports", msgs)
+	}
+}
+
+func TestErrorWrap(t *testing.T) {
+	errBoom := errors.New("boom")
+	boom := func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		return nil, errBoom
+	}
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+		"boom":  starlark.NewBuiltin("boom", boom),
+	}
+	src := `
+g = group()
+g.go(boom)
+g.wait()
+`
+	thread := &starlark.Thread{Name: "main"}
+	_, err := starlark.ExecFile(thread, "wrap.star", src, globals)
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("got %v, want %v", err, errBoom)
+	}
+	if want := "group call 0 (boom): boom"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	panics := func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		panic("oops")
+	}
+	globals := starlark.StringDict{
+		"group":  starlark.NewBuiltin("group", Make),
+		"panics": starlark.NewBuiltin("panics", panics),
+	}
+	src := `
+g = group()
+g.go(panics)
+g.wait()
+`
+	thread := &starlark.Thread{Name: "main"}
+	_, err := starlark.ExecFile(thread, "panic.star", src, globals)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{"group call 0 (panics): panic: oops", "TestPanic"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %q, want %q", err, want)
+		}
+	}
+
+	// The Starlark call stack locates the panic in the script.
+	src = `
+def calls_panics():
+    panics()
+
+g = group()
+g.go(calls_panics)
+g.wait()
+`
+	_, err = starlark.ExecFile(thread, "panic.star", src, globals)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{"panic.star:3:11: in calls_panics", "panic: oops"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %q, want %q", err, want)
+		}
+	}
+
+	// Panics of the arg function are recovered too.
+	src = `
+g = group()
+g.go(lambda x: x, arg_fn = panics)
+g.wait()
+`
+	_, err = starlark.ExecFile(thread, "panic.star", src, globals)
+	if err == nil || !strings.Contains(err.Error(), "group call 0 (lambda): arg_fn: panic: oops") {
+		t.Fatalf("got %v, want arg_fn panic", err)
+	}
+
+	// Panics of the error handler are recovered too.
+	src = `
+g = group()
+g.go(fail, "boom", on_error = panics)
+g.wait()
+`
+	_, err = starlark.ExecFile(thread, "panic.star", src, globals)
+	if err == nil || !strings.Contains(err.Error(), "group call 0 (fail): on_error: panic: oops") {
+		t.Fatalf("got %v, want on_error panic", err)
+	}
+}
+
+func TestErrorBacktrace(t *testing.T) {
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+	}
+	src := `
+def boom():
+    fail("boom")
+
+g = group()
+g.go(boom)
+g.wait()
+`
+	thread := &starlark.Thread{Name: "main"}
+	_, err := starlark.ExecFile(thread, "backtrace.star", src, globals)
+
+	// The first eval error is of the waiting thread, unwrap to the call.
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("got %v, want eval error", err)
+	}
+	if !errors.As(evalErr.Unwrap(), &evalErr) {
+		t.Fatalf("got %v, want wrapped call eval error", evalErr.Unwrap())
+	}
+	if bt := evalErr.Backtrace(); !strings.Contains(bt, "backtrace.star:3:9: in boom") {
+		t.Errorf("got %q, want position of boom", bt)
+	}
+}
+
+type recordHooks struct {
+	mu                           sync.Mutex
+	scheduled, started, complete []int
+	errs                         int
+}
+
+func (h *recordHooks) OnSchedule(i int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.scheduled = append(h.scheduled, i)
+}
+func (h *recordHooks) OnStart(i int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = append(h.started, i)
+}
+func (h *recordHooks) OnComplete(i int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.complete = append(h.complete, i)
+	if err != nil {
+		h.errs++
+	}
+}
+
+func TestHooks(t *testing.T) {
+	g := NewGroup(context.Background(), WithConcurrency(2), WithFailFast(false))
+	hooks := &recordHooks{}
+	g.SetHooks(hooks)
+
+	globals := starlark.StringDict{
+		"g": g,
+	}
+	src := `
+def check_even(x):
+    if x % 2:
+        fail("odd value", x)
+    return x
+
+g.map(check_even, range(5))
+g.go(check_even, 6)
+g.wait()
+`
+	thread := &starlark.Thread{Name: "main"}
+	if _, err := starlark.ExecFile(thread, "hooks.star", src, globals); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ids := range [][]int{hooks.scheduled, hooks.started, hooks.complete} {
+		sort.Ints(ids)
+		if got, want := fmt.Sprint(ids), "[0 1 2 3 4 5]"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if hooks.errs != 2 {
+		t.Errorf("got %d errors, want 2", hooks.errs)
+	}
+}
+
+type spanKey struct{}
+
+func TestStartSpan(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		spans []string
+	)
+	startSpan := func(ctx context.Context, name string) (context.Context, func(error)) {
+		return context.WithValue(ctx, spanKey{}, name), func(err error) {
+			status := "ok"
+			if err != nil {
+				status = "error"
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			spans = append(spans, name+":"+status)
+		}
+	}
+	spanName := func(thread *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		ctx := thread.Local("context").(context.Context)
+		name, _ := ctx.Value(spanKey{}).(string)
+		return starlark.String(name), nil
+	}
+
+	g := NewGroup(context.Background(), WithFailFast(false))
+	g.SetStartSpan(startSpan)
+
+	globals := starlark.StringDict{
+		"g":         g,
+		"span_name": starlark.NewBuiltin("span_name", spanName),
+	}
+	src := `
+def fetch():
+    return span_name()
+
+def boom():
+    fail("boom")
+
+g.go(fetch)
+g.go(boom)
+res = g.wait()
+`
+	thread := &starlark.Thread{Name: "main"}
+	out, err := starlark.ExecFile(thread, "span.star", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out["res"].(starlark.Tuple)[0], starlark.String("fetch"); got != want {
+		t.Errorf("got span %v, want %v", got, want)
+	}
+
+	sort.Strings(spans)
+	if got, want := fmt.Sprint(spans), "[boom:error fetch:ok]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestReuseWorkers(t *testing.T) {
+	g := NewGroup(context.Background(), WithConcurrency(2), WithReuseWorkers(true))
+	defer g.StopWorkers()
+
+	globals := starlark.StringDict{
+		"g": g,
+	}
+	src := `
+g.reset()
+g.map(lambda x: x * x, range(8))
+res = g.wait()
+`
+	var w *workers
+	for i := 0; i < 2; i++ {
+		thread := &starlark.Thread{Name: "main"}
+		out, err := starlark.ExecFile(thread, "reuse.star", src, globals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out["res"].String(), "(0, 1, 4, 9, 16, 25, 36, 49)"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+		if i == 0 {
+			w = g.workers
+		}
+		if g.workers == nil || g.workers != w {
+			t.Fatalf("batch %d: workers %p, want %p", i, g.workers, w)
+		}
+	}
+}
+
+func TestReuseWorkersClose(t *testing.T) {
+	thread := &starlark.Thread{Name: "main"}
+	for _, src := range []string{`
+g.map(lambda x: x, range(4))
+g.wait()
+g.close()
+`, `
+g.go(lambda: g.close())
+g.map(lambda x: x, range(4))
+g.wait_partial()
+`} {
+		g := NewGroup(context.Background(), WithConcurrency(2), WithReuseWorkers(true))
+		globals := starlark.StringDict{
+			"g": g,
+		}
+		if _, err := starlark.ExecFile(thread, "close.star", src, globals); err != nil {
+			t.Fatal(err)
+		}
+		if g.workers != nil {
+			t.Errorf("%s: workers still running after close", src)
+		}
+	}
+}
+
+func TestReuseWorkersCancel(t *testing.T) {
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+		"sleep": starlark.NewBuiltin("sleep", sleep),
+	}
+	src := `
+g = group(n = 4, reuse_workers = True)
+g.map(lambda i: sleep("10ms") or g.cancel(), range(4))
+g.wait_partial()
+`
+	for i := 0; i < 20; i++ {
+		thread := &starlark.Thread{Name: "main"}
+		if _, err := starlark.ExecFile(thread, "cancel.star", src, globals); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWait(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse_workers=%t", reuse), func(b *testing.B) {
+			g := NewGroup(context.Background(), WithConcurrency(4), WithReuseWorkers(reuse))
+			defer g.StopWorkers()
+
+			globals := starlark.StringDict{
+				"g": g,
+			}
+			src := `
+g.reset()
+g.map(lambda x: x, range(16))
+g.wait()
+`
+			_, prog, err := starlark.SourceProgram("bench.star", src, globals.Has)
+			if err != nil {
+				b.Fatal(err)
+			}
+			thread := &starlark.Thread{Name: "main"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := prog.Init(thread, globals); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParentDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	thread := &starlark.Thread{Name: "main"}
+	thread.SetLocal("context", ctx)
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+	}
+	src := `
+def spin():
+    for i in range(1000000000):
+        pass
+
+g = group(timeout = "10s")
+g.go(spin)
+g.wait()
+`
+	start := time.Now()
+	_, err := starlark.ExecFile(thread, "deadline.star", src, globals)
+	if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Fatalf("got %v, want context deadline exceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("wait took %v, want parent deadline", d)
+	}
+}
+
+func TestParentCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	thread := &starlark.Thread{Name: "main"}
+	thread.SetLocal("context", ctx)
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+		"sleep": starlark.NewBuiltin("sleep", sleep),
+	}
+	src := `
+g = group(n = 2)
+g.map(sleep, ["1s"] * 8)
+g.wait()
+`
+	start := time.Now()
+	_, err := starlark.ExecFile(thread, "cancel.star", src, globals)
+	if err == nil || !strings.Contains(err.Error(), "context canceled") {
+		t.Fatalf("got %v, want context canceled", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("wait took %v, want prompt return on cancel", d)
+	}
+}
+
+func TestParentCancelReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	thread := &starlark.Thread{Name: "main"}
+	thread.SetLocal("context", ctx)
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+		"sleep": starlark.NewBuiltin("sleep", sleep),
+	}
+	src := `
+g = group(n = 2)
+g.map(sleep, ["50ms"] * 8)
+g.wait_partial()
+g.reset()
+`
+	if _, err := starlark.ExecFile(thread, "reset.star", src, globals); err != nil && !strings.Contains(err.Error(), "context canceled") {
+		t.Fatal(err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const jitter = 20 * time.Millisecond
+	g := NewGroup(context.Background(),
+		WithConcurrency(1),
+		WithJitter(jitter),
+		WithRand(rand.New(rand.NewSource(1))),
+	)
+
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	now := func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		return starlark.None, nil
+	}
+	globals := starlark.StringDict{
+		"g":   g,
+		"now": starlark.NewBuiltin("now", now),
+	}
+	src := `
+g.map(lambda _: now(), range(6))
+g.wait()
+`
+	start := time.Now()
+	thread := &starlark.Thread{Name: "main"}
+	if _, err := starlark.ExecFile(thread, "jitter.star", src, globals); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each call is delayed by the seeded jitter, so gaps are not periodic.
+	checkJitter(t, start, times, jitter, 1)
+}
+
+// checkJitter checks the calls at times were delayed by the jitter of the
+// seeded source.
+func checkJitter(t *testing.T, start time.Time, times []time.Time, jitter time.Duration, seed int64) {
+	t.Helper()
+	r := rand.New(rand.NewSource(seed))
+	prev := start
+	gaps := make(map[time.Duration]bool)
+	for i, at := range times {
+		want := time.Duration(r.Int63n(int64(jitter) + 1))
+		if got := at.Sub(prev); got < want {
+			t.Errorf("call %d: delayed %v, want at least %v", i, got, want)
+		}
+		gaps[want.Round(time.Millisecond)] = true
+		prev = at
+	}
+	if len(gaps) < 2 {
+		t.Errorf("got periodic delays %v", gaps)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	var times []time.Time
+	now := func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		times = append(times, time.Now())
+		return starlark.None, nil
+	}
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+		"now":   starlark.NewBuiltin("now", now),
+	}
+	src := `
+g = group(serial = True, jitter = "20ms", seed = 7)
+g.map(lambda _: now(), range(6))
+g.wait()
+`
+	// The same seed delays the calls by the same jitter on every run.
+	for run := 0; run < 2; run++ {
+		times = nil
+		start := time.Now()
+		thread := &starlark.Thread{Name: "main"}
+		if _, err := starlark.ExecFile(thread, "seed.star", src, globals); err != nil {
+			t.Fatal(err)
+		}
+		checkJitter(t, start, times, 20*time.Millisecond, 7)
+	}
+
+	thread := &starlark.Thread{Name: "main"}
+	if _, err := starlark.ExecFile(thread, "seed.star", `group(seed = "1")`, globals); err == nil || err.Error() != "group: for parameter seed: got string, want int" {
+		t.Errorf("got %v, want seed type error", err)
+	}
+}
+
+func TestNoNilResults(t *testing.T) {
+	globals := starlark.StringDict{
+		"group": starlark.NewBuiltin("group", Make),
+	}
+	src := `
+def work(i):
+    if i == 2:
+        g.cancel()
+    return i
+
+g = group(n = 1)
+g.map(work, range(6))
+res, err = g.wait_partial()
+`
+	thread := &starlark.Thread{Name: "main"}
+	out, err := starlark.ExecFile(thread, "nil.star", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out["err"] == starlark.None {
+		t.Fatal("expected the wait to be cancelled")
+	}
+	res := out["res"].(starlark.Tuple)
+	if len(res) != 6 {
+		t.Fatalf("got %d results, want 6", len(res))
+	}
+	for i, v := range res {
+		if v == nil {
+			t.Errorf("result %d is nil", i)
+		}
+	}
+	if got, want := res[5], starlark.Value(starlark.None); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestResults(t *testing.T) {
+	g := NewGroup(context.Background(), WithConcurrency(2))
+	if res := g.Results(); res != nil {
+		t.Fatalf("got %v before wait, want nil", res)
+	}
+
+	globals := starlark.StringDict{
+		"g": g,
+	}
+	src := `
+g.map(lambda x: x * x, range(4))
+g.wait()
+`
+	thread := &starlark.Thread{Name: "main"}
+	if _, err := starlark.ExecFile(thread, "results.star", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.Results().String(), "(0, 1, 4, 9)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	g := NewGroup(context.Background(), WithConcurrency(2))
+
+	thread := &starlark.Thread{Name: "main"}
+	globals := starlark.StringDict{
+		"g": g,
+	}
+	_, prog, err := starlark.SourceProgram("add.star", `
+def scale(x, factor = 1):
+    return x * factor
+`, globals.Has)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := prog.Init(thread, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scale := mod["scale"].(starlark.Callable)
+
+	for i := 0; i < 3; i++ {
+		kwargs := []starlark.Tuple{
+			{starlark.String("factor"), starlark.MakeInt(10)},
+			{starlark.String("priority"), starlark.MakeInt(i)},
+		}
+		if err := g.Add(scale, starlark.Tuple{starlark.MakeInt(i)}, kwargs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Add(starlark.Universe["len"].(starlark.Callable), starlark.Tuple{starlark.String("abc")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := g.Wait(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.String(), "(0, 10, 20, 3)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := g.Wait(thread); err == nil || !strings.HasPrefix(err.Error(), "group.wait: already waited") {
+		t.Errorf("got %v, want already waited error", err)
+	}
+
+	if err := g.Add(scale, nil, nil); err == nil || err.Error() != "group: frozen" {
+		t.Errorf("got %v, want frozen error", err)
+	}
+}
+
+func TestWaitError(t *testing.T) {
+	g := NewGroup(context.Background(), WithConcurrency(1))
+
+	thread := &starlark.Thread{Name: "main"}
+	fail := starlark.Universe["fail"].(starlark.Callable)
+	sq := starlark.NewBuiltin("square", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		x, _ := starlark.AsInt32(args[0])
+		return starlark.MakeInt(x * x), nil
+	})
+	for _, err := range []error{
+		g.Add(sq, starlark.Tuple{starlark.MakeInt(2)}, nil),
+		g.Add(fail, starlark.Tuple{starlark.String("boom")}, nil),
+		g.Add(sq, starlark.Tuple{starlark.MakeInt(3)}, nil),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := g.Wait(thread)
+	if err == nil || !strings.Contains(err.Error(), "group call 1 (fail): fail: boom") {
+		t.Fatalf("got %v, want call 1 error", err)
+	}
+	if got, want := res[0], starlark.Value(starlark.MakeInt(4)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if g.Results() != nil {
+		t.Errorf("got results %v after failed wait", g.Results())
+	}
+}
+
+func TestWaitNested(t *testing.T) {
+	g := NewGroup(context.Background())
+
+	thread := &starlark.Thread{Name: "main"}
+	sq := starlark.NewBuiltin("square", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		x, _ := starlark.AsInt32(args[0])
+		return starlark.MakeInt(x * x), nil
+	})
+	sub := starlark.NewBuiltin("sub", func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		g := NewGroup(context.Background())
+		for i := 0; i < 2; i++ {
+			if err := g.Add(sq, starlark.Tuple{starlark.MakeInt(i)}, nil); err != nil {
+				return nil, err
+			}
+		}
+		return g, nil
+	})
+	if err := g.Add(sub, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add(sq, starlark.Tuple{starlark.MakeInt(2)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := g.Wait(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.String(), "(0, 1, 4)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := g.Results().String(), res.String(); got != want {
+		t.Errorf("got results %s, want %s", got, want)
+	}
+}
+
+func TestWaitDefault(t *testing.T) {
+	g := NewGroup(context.Background(), WithFailFast(false), WithDefault(starlark.MakeInt(-1)))
+
+	thread := &starlark.Thread{Name: "main"}
+	fail := starlark.Universe["fail"].(starlark.Callable)
+	if err := g.Add(fail, starlark.Tuple{starlark.String("boom")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := g.Wait(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.String(), "(-1,)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := g.Results().String(), "(-1,)"; got != want {
+		t.Errorf("got results %s, want %s", got, want)
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(10*time.Millisecond), 1)
+
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	now := starlark.NewBuiltin("now", func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		return starlark.None, nil
+	})
+
+	// Both groups are unlimited but share the limiter.
+	var groups []*Group
+	for i := 0; i < 2; i++ {
+		g := NewGroup(context.Background(), WithLimiter(limiter))
+		for j := 0; j < 5; j++ {
+			if err := g.Add(now, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		groups = append(groups, g)
+	}
+
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g *Group) {
+			defer wg.Done()
+			if _, err := g.Wait(&starlark.Thread{Name: "main"}); err != nil {
+				t.Error(err)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	if d := times[len(times)-1].Sub(times[0]); d < 80*time.Millisecond {
+		t.Errorf("10 calls ran in %v, want a shared rate of one per 10ms", d)
+	}
+
+	globals := starlark.StringDict{
+		"g": groups[0],
+	}
+	_, err := starlark.ExecFile(&starlark.Thread{Name: "main"}, "limit.star", `g.set_limit("1ms")`, globals)
+	if err == nil || !strings.Contains(err.Error(), "group.set_limit: limiter is shared") {
+		t.Errorf("got %v, want shared limiter error", err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	g := NewGroup(context.Background())
+	if err := g.Add(starlark.NewBuiltin("sleep", sleep), starlark.Tuple{starlark.String("10ms")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-g.Done():
+		t.Fatal("done before wait")
+	default:
+	}
+
+	go func() {
+		if _, err := g.Wait(&starlark.Thread{Name: "main"}); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-g.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for done")
+	}
+	if got, want := g.Results().String(), "(None,)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSharedSemaphore(t *testing.T) {
+	sem := semaphore.NewWeighted(2)
+
+	var (
+		mu            sync.Mutex
+		running, peak int
+	)
+	work := starlark.NewBuiltin("work", func(_ *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return starlark.None, nil
+	})
+
+	// Both groups are unbounded but share the semaphore.
+	var groups []*Group
+	for i := 0; i < 2; i++ {
+		g := NewGroup(context.Background(), WithSemaphore(sem))
+		for j := 0; j < 5; j++ {
+			if err := g.Add(work, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		groups = append(groups, g)
+	}
+
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g *Group) {
+			defer wg.Done()
+			if _, err := g.Wait(&starlark.Thread{Name: "main"}); err != nil {
+				t.Error(err)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if peak != 2 {
+		t.Errorf("got %d calls running at once, want the semaphore weight 2", peak)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Second), 3)
+	hooks := &recordHooks{}
+	for _, tt := range []struct {
+		name  string
+		opts  []Option
+		check func(g *Group) error
+	}{{
+		name: "default",
+		check: func(g *Group) error {
+			if g.n != 0 || g.limiter.Limit() != rate.Inf || !g.failFast || g.name != "group" {
+				return fmt.Errorf("got n=%d limit=%v fail_fast=%t name=%q", g.n, g.limiter.Limit(), g.failFast, g.name)
+			}
+			return nil
+		},
+	}, {
+		name: "concurrency",
+		opts: []Option{WithConcurrency(4)},
+		check: func(g *Group) error {
+			if g.n != 4 {
+				return fmt.Errorf("got n=%d, want 4", g.n)
+			}
+			return nil
+		},
+	}, {
+		name: "rate",
+		opts: []Option{WithRate(rate.Every(time.Millisecond), 2)},
+		check: func(g *Group) error {
+			if l := g.limiter; l.Limit() != rate.Every(time.Millisecond) || l.Burst() != 2 {
+				return fmt.Errorf("got limit=%v burst=%d", l.Limit(), l.Burst())
+			}
+			return nil
+		},
+	}, {
+		name: "limiter",
+		opts: []Option{WithLimiter(limiter)},
+		check: func(g *Group) error {
+			if g.limiter != limiter || !g.sharedLimiter {
+				return fmt.Errorf("got limiter %p, want %p", g.limiter, limiter)
+			}
+			return nil
+		},
+	}, {
+		name: "name",
+		opts: []Option{WithName("fetch")},
+		check: func(g *Group) error {
+			if g.name != "fetch" {
+				return fmt.Errorf("got name %q, want fetch", g.name)
+			}
+			return nil
+		},
+	}, {
+		name: "timeout",
+		opts: []Option{WithTimeout(time.Minute)},
+		check: func(g *Group) error {
+			if _, ok := g.ctx.Deadline(); !ok {
+				return fmt.Errorf("got no deadline")
+			}
+			return nil
+		},
+	}, {
+		name: "fail_fast",
+		opts: []Option{WithFailFast(false)},
+		check: func(g *Group) error {
+			if g.failFast {
+				return fmt.Errorf("got fail fast")
+			}
+			return nil
+		},
+	}, {
+		name: "retries",
+		opts: []Option{WithRetries(3, time.Millisecond, time.Second)},
+		check: func(g *Group) error {
+			if g.retries != 3 || g.backoff != time.Millisecond || g.backoffMax != time.Second {
+				return fmt.Errorf("got retries=%d backoff=%v max=%v", g.retries, g.backoff, g.backoffMax)
+			}
+			return nil
+		},
+	}, {
+		name: "hooks",
+		opts: []Option{WithHooks(hooks)},
+		check: func(g *Group) error {
+			if g.hooks != hooks {
+				return fmt.Errorf("got hooks %v", g.hooks)
+			}
+			return nil
+		},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGroup(context.Background(), tt.opts...)
+			defer g.cancel()
+			if err := tt.check(g); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewGroupLimit(t *testing.T) {
+	g := NewGroupLimit(context.Background(), 2, rate.Every(time.Second), 1)
+	if g.n != 2 || g.limiter.Limit() != rate.Every(time.Second) || g.limiter.Burst() != 1 {
+		t.Errorf("got n=%d limit=%v burst=%d", g.n, g.limiter.Limit(), g.limiter.Burst())
+	}
+}